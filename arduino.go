@@ -4,151 +4,36 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"io"
 	"strings"
 	"time"
 
 	"github.com/tarm/serial"
 )
 
-var cmd = `#!/bin/bash
-for sysdevpath in $(find /sys/bus/usb/devices/usb*/ -name dev); do 
-(
-syspath="${sysdevpath%/dev}"
-devname="$(udevadm info -q name -p $syspath)"
-[[ "$devname" == "bus/"* ]] && continue
-eval "$(udevadm info -q property --export -p $syspath)"
-[[ -z "$ID_SERIAL" ]] && continue
-echo -e "/dev/$devname - $ID_SERIAL\n"
-)
-done `
-
-func sendError(timeout time.Duration, err error, errorC chan<- error) {
-	select {
-	case <-time.After(timeout):
-	case errorC <- err:
-	}
-}
-
-func run(timeout time.Duration, outputC chan string, errorC chan error, command string, args ...string) {
-
-	defer func() {
-		errorC <- nil
-	}()
-
-	// instantiate new command
-	cmd := exec.Command(command, args...)
-
-	// get pipe to standard output
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		sendError(timeout, err, errorC)
-		return
-	}
-
-	// start process via command
-	if err := cmd.Start(); err != nil {
-		sendError(timeout, err, errorC)
-		return
-	}
-
-	// setup a buffer to capture standard output
-	var buf bytes.Buffer
-
-	// create a channel to capture any errors from wait
-	done := make(chan error)
-	go func() {
-		if _, err := buf.ReadFrom(stdout); err != nil {
-			sendError(timeout, err, errorC)
-		}
-		done <- cmd.Wait()
-	}()
-
-	// block on select, and switch based on actions received
-	select {
-	case <-time.After(timeout):
-		if err := cmd.Process.Kill(); err != nil {
-			sendError(timeout, err, errorC)
-			return
-		}
-		sendError(timeout, fmt.Errorf("process timed out"), errorC)
-		return
-	case err := <-done:
-		if err != nil {
-			sendError(timeout, err, errorC)
-			close(done)
-
-		}
-		outputC <- buf.String()
-	}
-}
-
 // findArduinos locates devices that implement the Arduino
 // serial connection.
 //
 // This function returns a collection of the devices
 // that are likely candidates for Arduino.
 //
-func findArduinos() (devices [][]string, err error) {
+func findArduinos(registry *deviceRegistry) (devices []usbSerialDevice, err error) {
 
-	// Create a script to do some device discovery
-	tmpfile, err := ioutil.TempFile("", "example")
+	found, err := enumerateUSBSerial(sysfsRoot)
 	if err != nil {
 		return nil, err
 	}
 
-	defer os.Remove(tmpfile.Name()) // clean up
-
-	if _, err = tmpfile.Write([]byte(cmd)); err != nil {
-		return nil, err
-	}
-	os.Chmod(tmpfile.Name(), 0700)
-	if err = tmpfile.Close(); err != nil {
-		return nil, err
-	}
-
-	devices = [][]string{}
-
-	outputC := make(chan string, 1)
-	defer close(outputC)
-
-	errorC := make(chan error, 1)
-	defer close(errorC)
-
-	go run(time.Duration(5*time.Second), outputC, errorC, tmpfile.Name())
-
-	for {
-		select {
-		case dev := <-outputC:
-			for _, line := range strings.Split(dev, "\n") {
-				if strings.Contains(line, "arduino") {
-					details := strings.Split(line, " -")
-					serial := strings.Split(line, "_")
-					devices = append(devices, []string{details[0], strings.TrimSpace(serial[len(serial)-1])})
-					continue
-				}
-				if strings.Contains(line, "ttyUSB") && strings.Contains(line, "USB_UART") {
-					details := strings.Split(line, " -")
-					deviceParts := strings.Split(details[0], "/")
-					if len(deviceParts) < 2 {
-						logW.Warn(fmt.Sprintf("Unexpected device line format %s", line))
-						continue
-					}
-					devices = append(devices, []string{details[0], strings.Trim(deviceParts[2], "/")})
-					continue
-				}
-			}
-		case err = <-errorC:
-			if err == nil {
-				return devices, nil
-			}
-			return nil, err
+	devices = []usbSerialDevice{}
+	for _, dev := range found {
+		if registry.known(&dev) || dev.isArduino() {
+			devices = append(devices, dev)
+			continue
 		}
+		logW.Trace(fmt.Sprintf("ignoring USB serial device %s", dev.String()))
 	}
+	return devices, nil
 }
 
 type arduino struct {
@@ -156,91 +41,248 @@ type arduino struct {
 	portal  string // The name of ingress portal that this control device is associated with
 	devName string // The tty style device name
 	role    string // The type of arduino that is present, core, or resonator cluster
+	name    string // The name given to the board in the device registry
+	key     string // The USB serial number of the board, or the device name when it is not known
+
+	proto int            // The version of the protocol used by the device
+	seq   byte           // The sequence number of the last version 2 frame sent
+	acks  chan *frameAck // Acknowledgements of version 2 frames
+
+	outbox *writeQueue // The lines waiting to be written to the device
 }
 
 // startDevice is used to start an individual arduino USB Serial device
 //
-func startDevice(portalName string, devName string) (device *arduino, err error) {
+func startDevice(portalName string, devName string, key string, entry *registeredDevice, settings serialSettings) (device *arduino, err error) {
 
-	device = &arduino{}
+	device = &arduino{
+		devName: devName,
+		portal:  portalName,
+		key:     key,
+		acks:    make(chan *frameAck, 4),
+	}
+	if entry != nil {
+		device.name = entry.Name
+	}
 
-	device.port, err = serial.OpenPort(&serial.Config{Name: devName, Baud: 9600, ReadTimeout: time.Duration(time.Second * 2)})
+	// When more than one baud rate is to be tried the device is reopened at
+	// each rate until it replies to the pings with its role
+	bauds := settings.bauds()
+	var reader *bufio.Reader
+	var reply string
 
-	if err != nil {
-		logW.Error(fmt.Sprintf("unable to open arduino at %s due to %s", devName, err.Error()), "error", err)
-		return nil, err
-	}
+	for i, baud := range bauds {
+		device.port, err = serial.OpenPort(settings.config(devName, baud))
 
-	// Let the device stabilize before continuing
-	select {
-	case <-time.After(2 * time.Second):
-	}
+		if err != nil {
+			logW.Error(fmt.Sprintf("unable to open arduino at %s due to %s", devName, err.Error()), "error", err)
+			return nil, err
+		}
+
+		if settle := settings.settle(); settle != 0 {
+			time.Sleep(settle)
+		}
+
+		reader = bufio.NewReader(device.port)
+		reply, err = device.ping(reader, settings.start())
+		if err != nil {
+			device.close()
+
+			logW.Error(fmt.Sprintf("unable to ping arduino at %s due to %s", devName, err.Error()), "error", err)
+			return nil, err
+		}
+
+		if len(bauds) == 1 {
+			break
+		}
+		if isRole(reply) {
+			logW.Info(fmt.Sprintf("arduino %s replied at %d baud", device.label(), baud))
+			break
+		}
 
-	if device.role, err = device.ping(); err != nil {
 		device.close()
+		if i == len(bauds)-1 {
+			err = fmt.Errorf("arduino %s did not reply at any of the baud rates %v", device.label(), bauds)
+			logW.Warn(err.Error())
+			return nil, err
+		}
+	}
+	device.role, device.proto = parseRole(reply)
 
-		logW.Error(fmt.Sprintf("unable to ping arduino at %s due to %s", devName, err.Error()), "error", err)
-		return nil, err
+	if entry != nil && len(entry.Role) != 0 && entry.Role != device.role {
+		logW.Warn(fmt.Sprintf("arduino %s has the role of '%s' but is registered as '%s'", device.label(), device.role, entry.Role))
 	}
 
-	device.devName = devName
-	device.portal = portalName
+	// Anything the device sends after its role is read in the background,
+	// and lines are written to the device in the background
+	go device.listen(reader, settings.readTimeout())
+
+	device.outbox = newWriteQueue(*writeQueueDepth)
+	go device.writer(device.outbox)
+
 	return device, nil
 }
 
-func findDevices() (devices []string) {
+const (
+	// pingInterval is the time allowed for an arduino to reply to a ping
+	// before it is pinged again, and pingLimit is the time allowed for an
+	// arduino to start after being opened, unless given in the serial settings
+	pingInterval = 500 * time.Millisecond
+	pingLimit    = 4 * time.Second
+)
+
+// findDevices returns the devices that should be used by each of the
+// portals.  Devices listed by the user can be assigned to a portal using
+// a 'portal=device' prefix, otherwise they, and automatically discovered
+// devices, are used by the first of the portals.  Registered boards that
+// are discovered are used by the portal given in the registry
+//
+func findDevices(portals []string, registry *deviceRegistry) (devices map[string][]string) {
 	// Parse the comma seperated device list
-	devices = strings.Split(*arduinos, ",")
+	devices, unassigned := parsePortalList(*arduinos, portals)
+
+	isPortal := make(map[string]bool, len(portals))
+	for _, portal := range portals {
+		isPortal[portal] = true
+	}
+
+	// The USB serial devices found, so that they can be looked up in the
+	// registry when started
+	found := []usbSerialDevice{}
 
 	// If the user did not specify arduinos to be used add then automatically
-	if len(devices) == 1 && len(devices[0]) == 0 {
-		deviceCatalog, err := findArduinos()
+	if len(devices) == 0 && len(unassigned) == 0 {
+		deviceCatalog, err := findArduinos(registry)
 		if err != nil {
-			logW.Error(err.Error())
-			os.Exit(-3)
-		}
-		if len(deviceCatalog) == 0 {
+			logW.Warn(fmt.Sprintf("USB serial devices could not be listed due to %s, software will continue running and looking for devices", err.Error()))
+		} else if len(deviceCatalog) == 0 {
 			logW.Warn("No arduinos were specified and none could not be found, software will continue running and looking for devices")
 		}
 
-		devices = make([]string, 0, len(deviceCatalog))
-		for _, attribs := range deviceCatalog {
-			logW.Trace(fmt.Sprintf("arduino '%s' serial # '%s'", attribs[0], attribs[1]), "arduinoDevice", attribs[0], "audrinoSerial", attribs[1])
-			devices = append(devices, attribs[0])
+		for _, dev := range deviceCatalog {
+			logW.Trace(fmt.Sprintf("arduino %s", dev.String()), "arduinoDevice", dev.Path, "audrinoSerial", dev.Serial)
+
+			found = append(found, dev)
+
+			entry, ok := registry.identify(&dev)
+			if !ok {
+				unassigned = append(unassigned, dev.Path)
+				continue
+			}
+
+			switch {
+			case len(entry.Portal) == 0:
+				unassigned = append(unassigned, dev.Path)
+			case isPortal[entry.Portal]:
+				devices[entry.Portal] = append(devices[entry.Portal], dev.Path)
+			default:
+				logW.Warn(fmt.Sprintf("arduino '%s' is registered for '%s' which is not a home portal", entry.Name, entry.Portal))
+				unassigned = append(unassigned, dev.Path)
+			}
+		}
+	} else if !registry.empty() {
+		// Devices given by the user are still identified so that they
+		// can be named and configured using the registry
+		if usbDevices, err := enumerateUSBSerial(sysfsRoot); err == nil {
+			found = usbDevices
 		}
 	}
+
+	registry.scanned(found)
+
+	if len(unassigned) != 0 {
+		devices[portals[0]] = append(devices[portals[0]], unassigned...)
+	}
 	return devices
 }
 
+// label returns the name used for the device when logging
+//
+func (dev *arduino) label() string {
+	if len(dev.name) != 0 {
+		return fmt.Sprintf("'%s' at %s", dev.name, dev.devName)
+	}
+	return "at " + dev.devName
+}
+
+// close closes the device, telling those with lines waiting to be written
+// that they will not be.  The port is left in place as the goroutines of the
+// device may still be using it, and they see the error of a closed file
+//
 func (dev *arduino) close() (err error) {
-	defer func() {
-		dev.port = nil
-	}()
+	if dev.outbox != nil {
+		for _, line := range dev.outbox.stop() {
+			line.report(errStopped)
+		}
+	}
 
 	return dev.port.Close()
 }
 
-func (dev *arduino) ping() (line string, err error) {
-
-	dev.port.Flush()
-
-	n, err := dev.port.Write([]byte("**********************\n"))
-	if err != nil {
-		return line, err
+// isRole tests whether a reply to a ping could be the role of a device, rather
+// than noise received at the wrong baud rate
+//
+func isRole(reply string) bool {
+	if len(reply) == 0 {
+		return false
 	}
-	if n != 2 {
-		logW.Warn(fmt.Sprintf("%d bytes written out of %d", n, 2))
+	for _, c := range reply {
+		if c < ' ' || c > '~' {
+			return false
+		}
 	}
+	return true
+}
+
+// ping asks the device for its role.  Arduinos reset when they are opened so
+// the ping is repeated until the device has started and replies, rather than
+// waiting a fixed time for it to stabilize
+//
+func (dev *arduino) ping(reader *bufio.Reader, limit time.Duration) (line string, err error) {
+
+	ping := []byte("**********************\n")
+	buf := []byte{}
 
-	reader := bufio.NewReader(dev.port)
-	buf, err := reader.ReadBytes('\x0a')
+	for deadline := time.Now().Add(limit); time.Now().Before(deadline); {
 
+		if len(buf) == 0 {
+			dev.port.Flush()
+
+			n, err := dev.port.Write(ping)
+			if err != nil {
+				return line, err
+			}
+			if n != len(ping) {
+				logW.Warn(fmt.Sprintf("%d bytes written out of %d", n, len(ping)))
+			}
+		}
+
+		// io.EOF is used by the serial device to indicate a read
+		// timeout, a partial reply is completed on the next read
+		chunk, err := reader.ReadBytes('\x0a')
+		buf = append(buf, chunk...)
+		if err == nil {
+			return strings.TrimSpace(string(buf)), nil
+		}
+		if err != io.EOF {
+			return line, err
+		}
+	}
+
+	logW.Warn(fmt.Sprintf("arduino at %s did not report its role", dev.devName))
 	return strings.TrimSpace(string(buf)), nil
 }
 
 func (dev *arduino) sendCmd(cmd []byte) (err error) {
+	if dev.proto >= 2 {
+		return dev.sendFrame(cmd)
+	}
+	return dev.write(cmd)
+}
 
-	dev.port.Flush()
+// writePort sends the bytes to the device, waiting for the write to complete
+//
+func (dev *arduino) writePort(cmd []byte) (err error) {
 
 	// TODO Add an incremental write loop for serial devices
 	n, err := dev.port.Write(cmd)
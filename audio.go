@@ -30,13 +30,19 @@ import (
 	"github.com/cvanderschuere/alsa-go"
 )
 
+const defaultAudioDir = "assets/sounds"
+
 var (
-	audioDir = flag.String("audioDir", "assets/sounds", "The directory in which the audio aiff formatted event files can be found")
+	audioDir = flag.String("audioDir", defaultAudioDir, "The directory in which the audio aiff formatted event files can be found, optionally a list of portal=directory entries for portals with their own sounds")
 )
 
-func initAudio(ambientC <-chan string, sfxC <-chan []string, quitC <-chan bool) (err error) {
+// initAudio starts the audio playback for a single home portal using the
+// sounds found in the dir directory.  Each home portal has its own pair of
+// ALSA streams, these are mixed together by the dmix device
+//
+func initAudio(dir string, ambientC <-chan string, sfxC <-chan []string, quitC <-chan bool) (err error) {
 
-	go runAudio(ambientC, sfxC, quitC)
+	go runAudio(dir, ambientC, sfxC, quitC)
 
 	return nil
 }
@@ -47,14 +53,7 @@ type effects struct {
 	sync.Mutex
 }
 
-var (
-	sfxs = effects{
-		wakeup: make(chan bool, 1),
-		sfxs:   []string{},
-	}
-)
-
-func playSFX(quitC <-chan bool) {
+func playSFX(sfxs *effects, quitC <-chan bool) {
 	//Open ALSA pipe
 	controlC := make(chan bool)
 	//Create stream
@@ -141,11 +140,16 @@ func playSFX(quitC <-chan bool) {
 // e-resonator-deployed, r-resonator-deployed
 // e-resonator-destroyed, r-resonator-destroyed
 
-func runAudio(ambientC <-chan string, sfxC <-chan []string, quitC <-chan bool) {
+func runAudio(dir string, ambientC <-chan string, sfxC <-chan []string, quitC <-chan bool) {
+
+	sfxs := &effects{
+		wakeup: make(chan bool, 1),
+		sfxs:   []string{},
+	}
 
-	go playAmbient(ambientC, quitC)
+	go playAmbient(dir, ambientC, quitC)
 
-	go playSFX(quitC)
+	go playSFX(sfxs, quitC)
 
 	for {
 		select {
@@ -154,7 +158,7 @@ func runAudio(ambientC <-chan string, sfxC <-chan []string, quitC <-chan bool) {
 			if len(fns) != 0 {
 				sfxs.Lock()
 				for _, fn := range fns {
-					sfxs.sfxs = append(sfxs.sfxs, filepath.Join(*audioDir, fn+".aiff"))
+					sfxs.sfxs = append(sfxs.sfxs, filepath.Join(dir, fn+".aiff"))
 				}
 				// Wait a maximum of three seconds to wake up the audio
 				// player for sound effects
@@ -176,7 +180,7 @@ type ambientFP struct {
 	sync.Mutex
 }
 
-func playAmbient(ambientC <-chan string, quitC <-chan bool) {
+func playAmbient(dir string, ambientC <-chan string, quitC <-chan bool) {
 
 	ambient := ambientFP{}
 
@@ -185,7 +189,7 @@ func playAmbient(ambientC <-chan string, quitC <-chan bool) {
 			select {
 			case fn := <-ambientC:
 				ambient.Lock()
-				ambient.fp = filepath.Join(*audioDir, fn)
+				ambient.fp = filepath.Join(dir, fn)
 				ambient.fp += ".aiff"
 				ambient.Unlock()
 			case <-quitC:
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"time"
 )
@@ -44,52 +42,68 @@ type status struct {
 
 type portalStatus struct {
 	Status status `json:"externalApiPortal"`
+	Source string `json:"-"` // The URI of the tecthulhu or concentrator that supplied the status
+}
+
+// copy returns a copy of the status that shares nothing with the original
+//
+func (state *portalStatus) copy() (copied *portalStatus) {
+	copied = &portalStatus{}
+	*copied = *state
+	copied.Status.Mods = append([]mod(nil), state.Status.Mods...)
+	copied.Status.Resonators = append([]resonator(nil), state.Status.Resonators...)
+	return copied
 }
 
 type concentrator struct {
 	url     string
 	statusC chan *portalStatus
 	errorC  chan error
+	http    *httpPoller
+}
+
+// decodeConcentrator parses a single JSON document in the concentrator format
+//
+func decodeConcentrator(body []byte) (status *portalStatus, err error) {
+	if err = json.Unmarshal(body, &status); err != nil {
+		logW.Debug(string(body))
+		logW.Debug(fmt.Sprintf("bad data %s", err))
+		return nil, err
+	}
+
+	// Use the spelling of the mods found in the catalog so that they
+	// match the mods from the tecthulhus
+	for i, m := range status.Status.Mods {
+		if kind, ok := modByName(m.Type, m.Rarity); ok {
+			status.Status.Mods[i].Type = kind.typ
+			status.Status.Mods[i].Rarity = kind.rarity
+		}
+	}
+	return status, nil
 }
 
 // checkPortal can be used to extract status information from the portal
 //
 func (conc *concentrator) checkPortal() (status *portalStatus, err error) {
 
-	body := []byte{}
 	url, err := url.Parse(conc.url)
 	if err != nil {
 		return nil, err
 	}
 
 	switch url.Scheme {
-	case "http":
-		resp, err := http.Get(url.String())
-		if err != nil {
-			return nil, err
-		}
-
-		body, err = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, err
+	case "http", "https":
+		if conc.http == nil {
+			conc.http = newHTTPPoller()
 		}
+		return conc.http.poll(url.String(), decodeConcentrator)
 
 	case "serial":
-		return nil, fmt.Errorf("Unknown scheme %s for the concentrator device is not yet implemented", url.Scheme)
+		return nil, fmt.Errorf("scheme %s for the concentrator device is streamed and cannot be polled", url.Scheme)
 
 	default:
 		return nil, fmt.Errorf("Unknown scheme %s for the concentrator device URI", url.Scheme)
 	}
-
-	err = json.Unmarshal(body, &status)
-	if err != nil {
-		logW.Debug(string(body))
-		logW.Debug(fmt.Sprintf("bad data %s", err))
-		return nil, err
-	}
-
-	return status, err
 }
 
 func (conc *concentrator) getStatus() {
@@ -102,28 +116,11 @@ func (conc *concentrator) getStatus() {
 	status, err := conc.checkPortal()
 
 	if err != nil {
-		err = fmt.Errorf("portal status for %s could not be retrieved due to %s", conc.url, err.Error())
-		go func() {
-			select {
-			case conc.errorC <- err:
-			case <-time.After(500 * time.Millisecond):
-				logW.Warn(fmt.Sprintf("could not send, error for ignored portal status update %s", err.Error()))
-			}
-		}()
+		publishError(fmt.Errorf("portal status for %s could not be retrieved due to %s", conc.url, err.Error()), conc.errorC)
 		return
 	}
 
-	select {
-	case conc.statusC <- status:
-	case <-time.After(750 * time.Millisecond):
-		go func() {
-			select {
-			case conc.errorC <- fmt.Errorf("portal status for %s had to be skipped", conc.url):
-			case <-time.After(2 * time.Second):
-				logW.Warn("could not send error for ignored portal status update")
-			}
-		}()
-	}
+	publishStatus(conc.url, status, conc.statusC, conc.errorC)
 }
 
 // startPortal listens to a concentrator device and returns
@@ -132,15 +129,35 @@ func (conc *concentrator) getStatus() {
 //
 func (conc *concentrator) startPortals(quitC chan bool) (err error) {
 
-	poll := time.NewTicker(2 * time.Second)
-	defer poll.Stop()
+	// Serial devices push line delimited JSon at their own pace
+	// and so are read continuously rather than being polled
+	if devURL, err := url.Parse(conc.url); err == nil && devURL.Scheme == "serial" {
+		feed := &serialFeed{
+			uri:     conc.url,
+			url:     devURL,
+			decode:  decodeConcentrator,
+			statusC: conc.statusC,
+			errorC:  conc.errorC,
+		}
+		return feed.start(quitC)
+	}
 
 	for {
 		select {
-		case <-poll.C:
+		case <-time.After(conc.pollDelay()):
 			conc.getStatus()
 		case <-quitC:
 			return
 		}
 	}
 }
+
+// pollDelay returns the time to wait before the next status check, this
+// grows while the concentrator is failing
+//
+func (conc *concentrator) pollDelay() (delay time.Duration) {
+	if conc.http == nil {
+		return *pollInterval
+	}
+	return conc.http.delay()
+}
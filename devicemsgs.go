@@ -0,0 +1,203 @@
+package main
+
+// This module implements the reading of the lines sent back by the arduinos.
+// Each device has a reader that parses the lines it sends into messages, and
+// logs them.  The messages are,
+//
+//   BTN <input>            a button, or other physical input, was activated
+//   SENSOR <input> <value> a reading from a sensor
+//   ERR <text>             an error detected by the device
+//   LOG <text>             debugging text
+//   ACK <seq>, NAK <seq>   acknowledgements of protocol version 2 frames
+//
+// Lines that do not start with one of these words are treated as debugging
+// text.  Button presses and sensor readings raise button-pressed and
+// sensor-reading events for the portal that the device belongs to, which are
+// processed using the rules in the same way as the events derived from the
+// portal status.  For example, a physical hack button could trigger a sound
+// using,
+//
+//   {"event": "button-pressed", "when": {"input": "hack"}, "sfx": ["e-capture"]}
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	msgButton = "button"
+	msgSensor = "sensor"
+	msgError  = "error"
+	msgDebug  = "debug"
+	msgAck    = "ack"
+)
+
+// deviceMessage is a single line received from an arduino
+//
+type deviceMessage struct {
+	portal  string
+	devName string
+	kind    string
+	input   string
+	value   string
+	text    string
+	ack     *frameAck
+}
+
+// deviceEventC carries the events raised by the arduinos to the gateway
+var deviceEventC = make(chan portalEvent, 16)
+
+// parseDeviceMessage converts a line received from a device into a message
+//
+func parseDeviceMessage(portal string, devName string, line string) (msg *deviceMessage) {
+
+	msg = &deviceMessage{
+		portal:  portal,
+		devName: devName,
+		kind:    msgDebug,
+		text:    line,
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return msg
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "BTN":
+		if len(fields) < 2 {
+			return msg
+		}
+		msg.kind = msgButton
+		msg.input = fields[1]
+	case "SENSOR":
+		if len(fields) < 3 {
+			return msg
+		}
+		msg.kind = msgSensor
+		msg.input = fields[1]
+		msg.value = strings.Join(fields[2:], " ")
+	case "ERR":
+		msg.kind = msgError
+		msg.text = strings.TrimSpace(line[len(fields[0]):])
+	case "LOG":
+		msg.text = strings.TrimSpace(line[len(fields[0]):])
+	case "ACK", "NAK":
+		if len(fields) != 2 {
+			return msg
+		}
+		ack, err := parseAck(fields[1], strings.ToUpper(fields[0]) == "ACK")
+		if err != nil {
+			return msg
+		}
+		msg.kind = msgAck
+		msg.ack = ack
+	}
+	return msg
+}
+
+func (msg *deviceMessage) String() string {
+	switch msg.kind {
+	case msgButton:
+		return fmt.Sprintf("arduino at %s for %s pressed %s", msg.devName, msg.portal, msg.input)
+	case msgSensor:
+		return fmt.Sprintf("arduino at %s for %s read %s from %s", msg.devName, msg.portal, msg.value, msg.input)
+	}
+	return fmt.Sprintf("arduino at %s for %s said %q", msg.devName, msg.portal, msg.text)
+}
+
+// event returns the gateway event raised by the message, if any
+//
+func (msg *deviceMessage) event() (ev *portalEvent) {
+	switch msg.kind {
+	case msgButton:
+		return &portalEvent{
+			Kind:   buttonPressed,
+			Portal: msg.portal,
+			Device: msg.devName,
+			Input:  msg.input,
+		}
+	case msgSensor:
+		return &portalEvent{
+			Kind:   sensorReading,
+			Portal: msg.portal,
+			Device: msg.devName,
+			Input:  msg.input,
+			Value:  msg.value,
+		}
+	}
+	return nil
+}
+
+// listen reads the lines sent by the device until the device is closed,
+// fails or is unplugged, logging each of the messages and raising their
+// events.  The read timeout is that of the port
+//
+func (dev *arduino) listen(reader *bufio.Reader, readTimeout time.Duration) {
+
+	line := make([]byte, 0, 128)
+	hangups := 0
+
+	for {
+		started := time.Now()
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		switch err {
+		case nil:
+			if text := strings.TrimSpace(string(line)); len(text) != 0 {
+				dev.received(parseDeviceMessage(dev.portal, dev.devName, text))
+			}
+			line = line[:0]
+		case bufio.ErrBufferFull, io.EOF:
+			// io.EOF is used by the serial device to indicate a read
+			// timeout.  A device that has been unplugged also returns
+			// io.EOF, but without waiting
+			if err == io.EOF && len(chunk) == 0 && time.Since(started) < readTimeout/10 {
+				if hangups++; hangups >= serialHangups {
+					logW.Debug(fmt.Sprintf("stopped reading arduino at %s as it was disconnected", dev.devName))
+					return
+				}
+			} else {
+				hangups = 0
+			}
+			// The line is discarded if it becomes too long
+			if len(line) > maxSerialLine {
+				line = line[:0]
+			}
+		default:
+			logW.Debug(fmt.Sprintf("stopped reading arduino at %s due to %s", dev.devName, err.Error()))
+			return
+		}
+	}
+}
+
+func (dev *arduino) received(msg *deviceMessage) {
+
+	switch msg.kind {
+	case msgAck:
+		logW.Trace(msg.String())
+		select {
+		case dev.acks <- msg.ack:
+		default:
+		}
+		return
+	case msgError:
+		logW.Warn(msg.String())
+	case msgDebug:
+		logW.Debug(msg.String())
+	default:
+		logW.Info(msg.String())
+	}
+
+	if ev := msg.event(); ev != nil {
+		select {
+		case deviceEventC <- *ev:
+		default:
+			logW.Warn(fmt.Sprintf("dropped %s from arduino at %s as the gateway is busy", ev.Kind, dev.devName))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDeviceMessage(t *testing.T) {
+
+	tests := []struct {
+		line     string
+		expected deviceMessage
+	}{
+		{"BTN hack", deviceMessage{kind: msgButton, input: "hack", text: "BTN hack"}},
+		{"btn  hack extra", deviceMessage{kind: msgButton, input: "hack", text: "btn  hack extra"}},
+		{"SENSOR temp 21.5 C", deviceMessage{kind: msgSensor, input: "temp", value: "21.5 C", text: "SENSOR temp 21.5 C"}},
+		{"ERR  motor stalled ", deviceMessage{kind: msgError, text: "motor stalled"}},
+		{"LOG booted", deviceMessage{kind: msgDebug, text: "booted"}},
+		{"ACK 1f", deviceMessage{kind: msgAck, text: "ACK 1f", ack: &frameAck{seq: 0x1f, ok: true}}},
+		{"nak 02", deviceMessage{kind: msgAck, text: "nak 02", ack: &frameAck{seq: 2, ok: false}}},
+
+		// Malformed messages are kept as debugging text
+		{"BTN", deviceMessage{kind: msgDebug, text: "BTN"}},
+		{"SENSOR temp", deviceMessage{kind: msgDebug, text: "SENSOR temp"}},
+		{"ACK", deviceMessage{kind: msgDebug, text: "ACK"}},
+		{"ACK 1 2", deviceMessage{kind: msgDebug, text: "ACK 1 2"}},
+		{"ACK zz", deviceMessage{kind: msgDebug, text: "ACK zz"}},
+		{"NAK 100", deviceMessage{kind: msgDebug, text: "NAK 100"}},
+		{"hello world", deviceMessage{kind: msgDebug, text: "hello world"}},
+		{"", deviceMessage{kind: msgDebug, text: ""}},
+	}
+
+	for _, test := range tests {
+		test.expected.portal, test.expected.devName = "P", "/dev/ttyACM0"
+		if msg := parseDeviceMessage("P", "/dev/ttyACM0", test.line); !reflect.DeepEqual(*msg, test.expected) {
+			t.Errorf("%q: expected %+v, not %+v", test.line, test.expected, *msg)
+		}
+	}
+}
+
+func TestDeviceListen(t *testing.T) {
+
+	// Forget any events left by other tests
+	for drained := false; !drained; {
+		select {
+		case <-deviceEventC:
+		default:
+			drained = true
+		}
+	}
+
+	dev := &arduino{portal: "P", devName: "/dev/ttyACM0", acks: make(chan *frameAck, 4)}
+
+	// The reader returns io.EOF straight away once the lines have been read,
+	// as an unplugged device does, which stops the listener
+	lines := "BTN hack\r\nSENSOR temp 21.5 C\nERR motor stalled\nhello\nACK 0a\n\npartial"
+	doneC := make(chan bool)
+	go func() {
+		dev.listen(bufio.NewReader(strings.NewReader(lines)), time.Second)
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the listener to stop once the device was disconnected")
+	}
+
+	expected := []portalEvent{
+		{Kind: buttonPressed, Portal: "P", Device: "/dev/ttyACM0", Input: "hack"},
+		{Kind: sensorReading, Portal: "P", Device: "/dev/ttyACM0", Input: "temp", Value: "21.5 C"},
+	}
+	for _, ev := range expected {
+		select {
+		case got := <-deviceEventC:
+			if got != ev {
+				t.Errorf("expected the event %+v, not %+v", ev, got)
+			}
+		default:
+			t.Errorf("expected the event %+v", ev)
+		}
+	}
+	select {
+	case got := <-deviceEventC:
+		t.Errorf("expected no more events, not %+v", got)
+	default:
+	}
+
+	select {
+	case ack := <-dev.acks:
+		if ack.seq != 0x0a || !ack.ok {
+			t.Errorf("expected the acknowledgement of frame 0A, not %+v", *ack)
+		}
+	default:
+		t.Error("expected the acknowledgement to be passed on")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+// This module implements the tracking of the state of each arduino, so that
+// arduinos that keep failing, for example a board with a bad cable that resets
+// each time it browns out, are not retried in a tight loop.  Each device is in
+// one of the states,
+//
+//   connecting    the device is being opened and pinged
+//   online        the device is running
+//   backoff       the device failed and will be retried once its backoff has
+//                 passed, the backoff doubles with each recent failure from
+//                 -backoff up to -backoffMax
+//   quarantined   the device failed -quarantine times within the
+//                 -quarantineWindow and will not be retried until it is
+//                 cleared by hand
+//   unplugged     the device went away, and is started when it is found
+//                 again
+//
+// Devices are identified by their USB serial number when it is known, so that
+// a board keeps its state when it is plugged back in under a new name, and
+// otherwise by their device name.  A device that fails to start, fails to be
+// written to, or is unplugged within -minUptime of starting counts as having
+// failed.  A device that has gone by the time it is opened does not.
+//
+// The states are served at /devices when the -api option is used, and a
+// quarantined device can be cleared using a POST to /devices/clear with the
+// device name, serial number or registry name, for example
+// /devices/clear?device=/dev/ttyACM0.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	backoffMin       = flag.Duration("backoff", time.Second, "The time before an arduino that has failed is retried, doubling for each recent failure")
+	backoffMax       = flag.Duration("backoffMax", 5*time.Minute, "The longest time before an arduino that has failed is retried")
+	quarantineLimit  = flag.Int("quarantine", 5, "The number of failures within the quarantine window after which an arduino is not retried until it is cleared, 0 to never quarantine")
+	quarantineWindow = flag.Duration("quarantineWindow", 10*time.Minute, "The period over which the failures of an arduino are counted")
+	minUptime        = flag.Duration("minUptime", 30*time.Second, "The time an arduino must have been running for before being unplugged is not counted as a failure")
+)
+
+const (
+	deviceConnecting  = "connecting"
+	deviceOnline      = "online"
+	deviceBackoff     = "backoff"
+	deviceQuarantined = "quarantined"
+	deviceUnplugged   = "unplugged"
+)
+
+// deviceState records the state of one device along with its recent failures
+//
+type deviceState struct {
+	key     string
+	devName string
+	name    string
+
+	state    string
+	onlineAt time.Time
+	failures []time.Time
+	retryAt  time.Time
+	lastErr  string
+}
+
+type deviceStates struct {
+	states map[string]*deviceState
+	sync.Mutex
+}
+
+var states = deviceStates{
+	states: map[string]*deviceState{},
+}
+
+// get returns the state of a device, adding it when needed, the caller must
+// hold the lock
+//
+func (all *deviceStates) get(key string, devName string) (state *deviceState) {
+	state, ok := all.states[key]
+	if !ok {
+		state = &deviceState{key: key, failures: []time.Time{}}
+		all.states[key] = state
+	}
+	state.devName = devName
+	return state
+}
+
+// connect tests whether the device can be started, and when it can, moves
+// the device to the connecting state
+//
+func (all *deviceStates) connect(key string, devName string, name string) (ok bool) {
+	all.Lock()
+	defer all.Unlock()
+
+	state := all.get(key, devName)
+	state.name = name
+
+	switch state.state {
+	case deviceQuarantined:
+		return false
+	case deviceBackoff:
+		if time.Now().Before(state.retryAt) {
+			return false
+		}
+		logW.Debug(fmt.Sprintf("retrying arduino %s after backoff", state.label()))
+	}
+	state.state = deviceConnecting
+	return true
+}
+
+// online records that the device has started
+//
+func (all *deviceStates) online(key string) {
+	all.Lock()
+	defer all.Unlock()
+
+	if state, ok := all.states[key]; ok && state.state == deviceConnecting {
+		state.state = deviceOnline
+		state.onlineAt = time.Now()
+	}
+}
+
+// failed records a failure of the device, moving it into backoff, or into
+// quarantine once it has failed too often
+//
+func (all *deviceStates) failed(key string, err error) {
+	all.Lock()
+	defer all.Unlock()
+
+	// A device is only counted as failing once for each time it is
+	// started, a write failing as the device is unplugged is not counted
+	// twice
+	state, ok := all.states[key]
+	if !ok || (state.state != deviceConnecting && state.state != deviceOnline) {
+		return
+	}
+	state.fail(err)
+}
+
+// unplugged records that the device has gone away.  A device that had not
+// been online for -minUptime counts as having failed, so that a board that
+// keeps resetting is backed off
+//
+func (all *deviceStates) unplugged(key string) {
+	all.Lock()
+	defer all.Unlock()
+
+	state, ok := all.states[key]
+	if !ok || (state.state != deviceConnecting && state.state != deviceOnline) {
+		return
+	}
+	if state.state == deviceOnline {
+		if uptime := time.Since(state.onlineAt); uptime < *minUptime {
+			state.fail(fmt.Errorf("the device was unplugged after %s", uptime.String()))
+			return
+		}
+	}
+	state.state = deviceUnplugged
+}
+
+// fail counts a failure of the device, the caller must hold the lock
+//
+func (state *deviceState) fail(err error) {
+
+	now := time.Now()
+	state.lastErr = err.Error()
+
+	// Only the failures within the window are counted
+	recent := []time.Time{}
+	for _, failure := range append(state.failures, now) {
+		if now.Sub(failure) < *quarantineWindow {
+			recent = append(recent, failure)
+		}
+	}
+	state.failures = recent
+
+	if *quarantineLimit > 0 && len(recent) >= *quarantineLimit {
+		state.state = deviceQuarantined
+		logW.Error(fmt.Sprintf("arduino %s has failed %d times within %s and is quarantined, last due to %s, POST /devices/clear?device=%s to retry it",
+			state.label(), len(recent), quarantineWindow.String(), state.lastErr, state.key))
+		return
+	}
+
+	delay := *backoffMin
+	for i := 1; i < len(recent) && delay < *backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > *backoffMax {
+		delay = *backoffMax
+	}
+	state.state = deviceBackoff
+	state.retryAt = now.Add(delay)
+	logW.Warn(fmt.Sprintf("arduino %s failed due to %s, retrying in %s", state.label(), state.lastErr, delay.String()))
+}
+
+// clear returns a quarantined device, identified by its key, device name or
+// registry name, to service
+//
+func (all *deviceStates) clear(device string) (err error) {
+	all.Lock()
+	defer all.Unlock()
+
+	for _, state := range all.states {
+		if state.key != device && state.devName != device && state.name != device {
+			continue
+		}
+		logW.Info(fmt.Sprintf("arduino %s was cleared, it was %s", state.label(), state.state))
+		delete(all.states, state.key)
+		return nil
+	}
+	return fmt.Errorf("unknown device '%s'", device)
+}
+
+// nextRetry returns the time until the earliest device in backoff can be
+// retried, ok is false when no devices are in backoff
+//
+func (all *deviceStates) nextRetry() (wait time.Duration, ok bool) {
+	all.Lock()
+	defer all.Unlock()
+
+	now := time.Now()
+	for _, state := range all.states {
+		if state.state != deviceBackoff {
+			continue
+		}
+		if until := state.retryAt.Sub(now); !ok || until < wait {
+			wait, ok = until, true
+		}
+	}
+	if ok && wait < 0 {
+		wait = 0
+	}
+	return wait, ok
+}
+
+func (state *deviceState) label() string {
+	if len(state.name) != 0 {
+		return fmt.Sprintf("'%s' at %s", state.name, state.devName)
+	}
+	return "at " + state.devName
+}
+
+// deviceStats is a snapshot of the state of a device and, when it is running,
+// of its queue
+//
+type deviceStats struct {
+	Portal   string `json:"portal,omitempty"`
+	Device   string `json:"device"`
+	Serial   string `json:"serial,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role,omitempty"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Error    string `json:"error,omitempty"`
+	RetryIn  string `json:"retryIn,omitempty"`
+
+	queueStats
+}
+
+// serveDevices writes the state of every device that has been seen, along
+// with the queue statistics of those that are running
+//
+func serveDevices(w http.ResponseWriter, r *http.Request) {
+
+	all := map[string]*deviceStats{}
+
+	states.Lock()
+	now := time.Now()
+	for _, state := range states.states {
+		stats := &deviceStats{
+			Device:   state.devName,
+			Name:     state.name,
+			State:    state.state,
+			Failures: len(state.failures),
+			Error:    state.lastErr,
+		}
+		if state.key != state.devName {
+			stats.Serial = state.key
+		}
+		if state.state == deviceBackoff && state.retryAt.After(now) {
+			stats.RetryIn = state.retryAt.Sub(now).String()
+		}
+		all[state.key] = stats
+	}
+	states.Unlock()
+
+	devices.Lock()
+	for _, portal := range devices.devices {
+		for _, dev := range portal {
+			stats, ok := all[dev.key]
+			if !ok {
+				stats = &deviceStats{Device: dev.devName, State: deviceOnline}
+				all[dev.key] = stats
+			}
+			stats.Portal = dev.portal
+			stats.Role = dev.role
+			if len(dev.name) != 0 {
+				stats.Name = dev.name
+			}
+			stats.queueStats = dev.outbox.stats()
+		}
+	}
+	devices.Unlock()
+
+	list := make([]*deviceStats, 0, len(all))
+	for _, stats := range all {
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Portal != list[j].Portal {
+			return list[i].Portal < list[j].Portal
+		}
+		return list[i].Device < list[j].Device
+	})
+
+	data, err := json.MarshalIndent(list, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// serveClear returns a quarantined device to service
+//
+func serveClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "devices are cleared using a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := states.clear(r.URL.Query().Get("device")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
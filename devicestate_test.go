@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// setDeviceFlags sets the backoff and quarantine options for a test, the
+// returned function restores them
+//
+func setDeviceFlags(min time.Duration, max time.Duration, limit int, window time.Duration) (restore func()) {
+	savedMin, savedMax, savedLimit, savedWindow, savedUptime := *backoffMin, *backoffMax, *quarantineLimit, *quarantineWindow, *minUptime
+	*backoffMin, *backoffMax, *quarantineLimit, *quarantineWindow = min, max, limit, window
+	return func() {
+		*backoffMin, *backoffMax, *quarantineLimit, *quarantineWindow, *minUptime = savedMin, savedMax, savedLimit, savedWindow, savedUptime
+	}
+}
+
+// failDevice starts the device and fails it, having first given it the
+// earlier failures, which are the times before now that they happened
+//
+func failDevice(all *deviceStates, key string, earlier ...time.Duration) (state *deviceState) {
+	all.connect(key, "/dev/ttyACM0", "north resonators")
+	state = all.states[key]
+	now := time.Now()
+	for _, ago := range earlier {
+		state.failures = append(state.failures, now.Add(-ago))
+	}
+	all.failed(key, fmt.Errorf("the device failed"))
+	return state
+}
+
+func TestDeviceBackoff(t *testing.T) {
+
+	defer setDeviceFlags(time.Second, 5*time.Second, 0, time.Hour)()
+
+	// The backoff doubles with each recent failure up to the limit
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{failures: 1, delay: time.Second},
+		{failures: 2, delay: 2 * time.Second},
+		{failures: 3, delay: 4 * time.Second},
+		{failures: 4, delay: 5 * time.Second},
+		{failures: 8, delay: 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		all := &deviceStates{states: map[string]*deviceState{}}
+		var state *deviceState
+		for i := 0; i != test.failures; i++ {
+			if state != nil {
+				if all.connect("85531303", "/dev/ttyACM0", "") {
+					t.Fatalf("%d failures: expected the device to wait for its backoff", test.failures)
+				}
+				state.retryAt = time.Now().Add(-time.Millisecond)
+			}
+			state = failDevice(all, "85531303")
+		}
+		if state.state != deviceBackoff {
+			t.Errorf("%d failures: expected the device to be in backoff, not %s", test.failures, state.state)
+			continue
+		}
+		if delay := state.retryAt.Sub(state.failures[len(state.failures)-1]); delay != test.delay {
+			t.Errorf("%d failures: expected a backoff of %s, not %s", test.failures, test.delay, delay)
+		}
+	}
+}
+
+func TestDeviceQuarantine(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		limit    int
+		earlier  []time.Duration
+		state    string
+		failures int
+		delay    time.Duration
+	}{
+		{name: "below the limit", limit: 3, earlier: []time.Duration{time.Minute}, state: deviceBackoff, failures: 2, delay: 2 * time.Second},
+		{name: "at the limit", limit: 3, earlier: []time.Duration{time.Minute, 2 * time.Minute}, state: deviceQuarantined, failures: 3},
+		{name: "expired", limit: 3, earlier: []time.Duration{11 * time.Minute, 20 * time.Minute}, state: deviceBackoff, failures: 1, delay: time.Second},
+		{name: "partly expired", limit: 3, earlier: []time.Duration{time.Minute, 11 * time.Minute}, state: deviceBackoff, failures: 2, delay: 2 * time.Second},
+		{name: "never", limit: 0, earlier: []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 4 * time.Minute}, state: deviceBackoff, failures: 5, delay: 16 * time.Second},
+	}
+
+	for _, test := range tests {
+		restore := setDeviceFlags(time.Second, time.Minute, test.limit, 10*time.Minute)
+
+		all := &deviceStates{states: map[string]*deviceState{}}
+		state := failDevice(all, "85531303", test.earlier...)
+
+		restore()
+
+		if state.state != test.state || len(state.failures) != test.failures {
+			t.Errorf("%s: expected the device to be %s with %d failures, not %s with %d", test.name, test.state, test.failures, state.state, len(state.failures))
+			continue
+		}
+		if test.state == deviceQuarantined {
+			state.retryAt = time.Time{}
+			if all.connect("85531303", "/dev/ttyACM0", "") {
+				t.Errorf("%s: expected the quarantined device not to be retried", test.name)
+			}
+			continue
+		}
+		if delay := state.retryAt.Sub(state.failures[len(state.failures)-1]); delay != test.delay {
+			t.Errorf("%s: expected a backoff of %s, not %s", test.name, test.delay, delay)
+		}
+	}
+}
+
+func TestDeviceClear(t *testing.T) {
+
+	defer setDeviceFlags(time.Second, time.Minute, 1, 10*time.Minute)()
+
+	tests := []struct {
+		device string
+		known  bool
+	}{
+		{device: "85531303", known: true},
+		{device: "/dev/ttyACM0", known: true},
+		{device: "north resonators", known: true},
+		{device: "/dev/ttyACM1"},
+		{device: ""},
+	}
+
+	for _, test := range tests {
+		all := &deviceStates{states: map[string]*deviceState{}}
+		if state := failDevice(all, "85531303"); state.state != deviceQuarantined {
+			t.Fatalf("expected the device to be quarantined, not %s", state.state)
+		}
+
+		err := all.clear(test.device)
+		if !test.known {
+			if err == nil {
+				t.Errorf("'%s': expected the device to be unknown", test.device)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': %s", test.device, err.Error())
+			continue
+		}
+		if !all.connect("85531303", "/dev/ttyACM0", "") {
+			t.Errorf("'%s': expected the cleared device to be started", test.device)
+		}
+		if failures := len(all.states["85531303"].failures); failures != 0 {
+			t.Errorf("'%s': expected the failures to be cleared, not %d", test.device, failures)
+		}
+	}
+}
+
+func TestDeviceUnplugged(t *testing.T) {
+
+	defer setDeviceFlags(time.Second, time.Minute, 5, 10*time.Minute)()
+	*minUptime = 30 * time.Second
+
+	tests := []struct {
+		name     string
+		online   bool
+		uptime   time.Duration
+		state    string
+		failures int
+	}{
+		{name: "resetting", online: true, uptime: time.Second, state: deviceBackoff, failures: 1},
+		{name: "unplugged", online: true, uptime: time.Minute, state: deviceUnplugged},
+		{name: "gone before being opened", state: deviceUnplugged},
+	}
+
+	for _, test := range tests {
+		all := &deviceStates{states: map[string]*deviceState{}}
+		all.connect("85531303", "/dev/ttyACM0", "")
+		if test.online {
+			all.online("85531303")
+			all.states["85531303"].onlineAt = time.Now().Add(-test.uptime)
+		}
+		all.unplugged("85531303")
+
+		// The write failing as the device goes away is not counted
+		all.failed("85531303", fmt.Errorf("the device went away"))
+
+		state := all.states["85531303"]
+		if state.state != test.state || len(state.failures) != test.failures {
+			t.Errorf("%s: expected the device to be %s with %d failures, not %s with %d", test.name, test.state, test.failures, state.state, len(state.failures))
+		}
+		if test.state == deviceUnplugged && !all.connect("85531303", "/dev/ttyACM1", "") {
+			t.Errorf("%s: expected the device to be started once it is found again", test.name)
+		}
+	}
+
+	// Devices that are not being started are not given a state
+	all := &deviceStates{states: map[string]*deviceState{}}
+	all.failed("", fmt.Errorf("the device failed"))
+	all.unplugged("85531303")
+	if len(all.states) != 0 {
+		t.Fatalf("expected no devices, not %d", len(all.states))
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+// This module implements the encoding of the portal status into the lines sent
+// to the arduinos.  Each arduino reports its role when it is pinged, and the
+// role selects the encoder used to generate the lines for that device.  Devices
+// with roles that are not recognized are sent the status line used by the
+// resonator nodes.
+//
+// The formats, all of which are terminated by a '\n', are,
+//
+//   status    Fnnnnnnnnp12345678mmmm  faction, resonator levels, portal health,
+//                                     resonator health and mods
+//   core      FLp                     faction, portal level and portal health
+//   mods      Fmmmm                   faction and mods
+//
+// F, n, p, the resonator health and m are encoded as described in the README.
+// L is the portal level as a single digit.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// roleEncoder generates the lines for the arduinos having a role containing
+// the match text
+//
+type roleEncoder struct {
+	name   string
+	match  string
+	encode func(state *portalStatus, factionChange bool) []byte
+}
+
+// roleEncoders are tested in order against the role of a device, with the
+// first that matches being used
+var roleEncoders = []*roleEncoder{
+	{name: "core", match: "core", encode: encodeCore},
+	{name: "mods", match: "mod", encode: encodeMods},
+	{name: "status", match: "resonator", encode: encodeStatus},
+}
+
+// defaultEncoder is used for the roles that do not match any of the encoders
+var defaultEncoder = &roleEncoder{name: "status", encode: encodeStatus}
+
+// encoderFor returns the encoder that generates lines for the role
+//
+func encoderFor(role string) (encoder *roleEncoder) {
+	role = strings.ToLower(role)
+	for _, encoder := range roleEncoders {
+		if strings.Contains(role, encoder.match) {
+			return encoder
+		}
+	}
+	return defaultEncoder
+}
+
+func encodePercent(v int) byte {
+	if v == 0 {
+		return ' '
+	}
+	return byte(int(' ') + (v / 2))
+}
+
+// encodeFaction returns the character for the faction holding the portal, in
+// uppercase when the faction has just changed
+//
+func encodeFaction(state *portalStatus, factionChange bool) (cmd []byte) {
+	cmd = make([]byte, 0, 1)
+	switch state.Status.ControllingFaction {
+	case "Neutral":
+		if factionChange {
+			cmd = append(cmd, 'N')
+		} else {
+			cmd = append(cmd, 'n')
+		}
+	case "Enlightened":
+		if factionChange {
+			cmd = append(cmd, 'E')
+		} else {
+			cmd = append(cmd, 'e')
+		}
+	case "Resistance":
+		if factionChange {
+			cmd = append(cmd, 'R')
+		} else {
+			cmd = append(cmd, 'r')
+		}
+	}
+	return cmd
+}
+
+// encodeModSlots returns a character for each of the four mod slots.  Mods
+// are placed using their slot, numbered from 0, so that an empty slot between
+// two mods stays empty
+//
+func encodeModSlots(state *portalStatus) (mods []byte) {
+	// Mods array handling, mods not in the catalog or in slots that do not
+	// exist are left as empty slots
+	mods = []byte{' ', ' ', ' ', ' '}
+	for _, mod := range state.Status.Mods {
+		slot := int(mod.Slot)
+		if slot < 0 || slot >= len(mods) {
+			continue
+		}
+		if kind, ok := modByName(mod.Type, mod.Rarity); ok {
+			mods[slot] = kind.proto
+		}
+	}
+	return mods
+}
+
+// encodeStatus generates the full status line used by the resonator nodes
+//
+func encodeStatus(state *portalStatus, factionChange bool) (cmd []byte) {
+	// Process the state updates into arduino CMDs and then send these to
+	// the arduinos that are listening and our associated with the home portal
+	// in any functional capacity
+	cmd = make([]byte, 0, 32)
+	cmd = append(cmd, encodeFaction(state, factionChange)...)
+
+	// Now dump out resonator levels, one character for each, and record the health values
+	resCmd := []byte{'0', '0', '0', '0', '0', '0', '0', '0'}
+	// Health values are encoded percentages, space for 0%
+	resHealth := []byte{' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+	// Translate an ascii compass point to a position in the resonators array
+	resPositionMap := map[string]int{"N": 2, "NE": 1, "E": 0, "SE": 7, "S": 6, "SW": 5, "W": 4, "NW": 3}
+
+	for _, res := range state.Status.Resonators {
+		if position, ok := resPositionMap[res.Position]; ok {
+			// After we have the position set the character in the resCmd for that
+			// position to the single ASCII digit the represents the level of the
+			// resonator
+			resCmd[position] = strconv.Itoa(int(res.Level))[0]
+			resHealth[position] = encodePercent(int(res.Health))
+		}
+	}
+
+	cmd = append(cmd, resCmd...)
+	cmd = append(cmd, encodePercent(int(state.Status.Health)))
+	cmd = append(cmd, resHealth...)
+
+	cmd = append(cmd, encodeModSlots(state)...)
+
+	// After printing the overall health output the per resonator health wih delimiters
+	return append(cmd, '\n')
+}
+
+// encodeCore generates the line used by the core of the portal
+//
+func encodeCore(state *portalStatus, factionChange bool) (cmd []byte) {
+	cmd = make([]byte, 0, 4)
+	cmd = append(cmd, encodeFaction(state, factionChange)...)
+	cmd = append(cmd, strconv.Itoa(int(state.Status.Level))[0])
+	cmd = append(cmd, encodePercent(int(state.Status.Health)))
+	return append(cmd, '\n')
+}
+
+// encodeMods generates the line used by the mod displays
+//
+func encodeMods(state *portalStatus, factionChange bool) (cmd []byte) {
+	cmd = make([]byte, 0, 6)
+	cmd = append(cmd, encodeFaction(state, factionChange)...)
+	cmd = append(cmd, encodeModSlots(state)...)
+	return append(cmd, '\n')
+}
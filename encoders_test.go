@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEncoderFor(t *testing.T) {
+	roles := map[string]string{
+		"Core-Left":      "core",
+		"mod display":    "mods",
+		"resonator-N":    "status",
+		"something else": "status",
+		"":               "status",
+	}
+	for role, name := range roles {
+		if encoder := encoderFor(role); encoder.name != name {
+			t.Errorf("expected the role '%s' to use the %s encoder, not %s", role, name, encoder.name)
+		}
+	}
+}
+
+func TestEncoders(t *testing.T) {
+
+	state := &portalStatus{Status: status{
+		ControllingFaction: "Enlightened",
+		Level:              7.6,
+		Health:             60,
+		Resonators: []resonator{
+			{Position: "N", Level: 8, Health: 100},
+			{Position: "E", Level: 1, Health: 50},
+			{Position: "SW", Level: 5, Health: 0},
+			{Position: "nowhere", Level: 3, Health: 100},
+		},
+		Mods: []mod{
+			{Slot: 0, Type: "Heat Sink", Rarity: "Rare"},
+			{Slot: 1, Type: "Not A Mod", Rarity: "Rare"},
+			{Slot: 2, Type: "Portal Shield", Rarity: "Common"},
+		},
+	}}
+
+	tests := []struct {
+		name          string
+		encode        func(state *portalStatus, factionChange bool) []byte
+		factionChange bool
+		line          string
+	}{
+		// The resonators are in the order E, NE, N, NW, W, SW, S, SE with the
+		// health of the portal between their levels and their health
+		{name: "status", encode: encodeStatus, line: "e10800500>9 R     2 A \n"},
+		{name: "status changed", encode: encodeStatus, factionChange: true, line: "E10800500>9 R     2 A \n"},
+		{name: "core", encode: encodeCore, line: "e7>\n"},
+		{name: "mods", encode: encodeMods, factionChange: true, line: "E2 A \n"},
+	}
+
+	for _, test := range tests {
+		if line := string(test.encode(state, test.factionChange)); line != test.line {
+			t.Errorf("%s: expected %q, not %q", test.name, test.line, line)
+		}
+	}
+}
+
+func TestEncodeFaction(t *testing.T) {
+	factions := map[string]string{"Neutral": "n", "Enlightened": "e", "Resistance": "r", "Unknown": ""}
+	for faction, encoded := range factions {
+		state := &portalStatus{Status: status{ControllingFaction: faction}}
+		if code := string(encodeFaction(state, false)); code != encoded {
+			t.Errorf("expected %s to be encoded as '%s', not '%s'", faction, encoded, code)
+		}
+	}
+}
+
+func TestEncodeModSlots(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		mods  []mod
+		slots string
+	}{
+		{name: "none", mods: []mod{}, slots: "    "},
+		// The mods are placed in their own slots, leaving the gaps empty
+		{name: "gap", mods: []mod{{Slot: 1, Type: "Heat Sink", Rarity: "Rare"}, {Slot: 3, Type: "Portal Shield", Rarity: "Common"}}, slots: " 2 A"},
+		{name: "unordered", mods: []mod{{Slot: 3, Type: "Portal Shield", Rarity: "Common"}, {Slot: 0, Type: "Heat Sink", Rarity: "Rare"}}, slots: "2  A"},
+		{name: "no slot", mods: []mod{{Slot: 4, Type: "Heat Sink", Rarity: "Rare"}, {Slot: -1, Type: "Heat Sink", Rarity: "Rare"}}, slots: "    "},
+	}
+
+	for _, test := range tests {
+		state := &portalStatus{Status: status{Mods: test.mods}}
+		if slots := string(encodeModSlots(state)); slots != test.slots {
+			t.Errorf("%s: expected %q, not %q", test.name, test.slots, slots)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+// This module implements the portal event model.  Events are derived by
+// comparing consecutive statuses for a portal and are used to drive the
+// audio, the arduinos and the logging rather than each of these inspecting
+// the statuses for themselves.
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	healthThresholds = flag.String("healthThresholds", "25,50,75", "A list of the portal health percentages that generate an event when crossed")
+)
+
+const (
+	factionChanged      = "faction-changed"
+	resonatorDeployed   = "resonator-deployed"
+	resonatorDestroyed  = "resonator-destroyed"
+	resonatorUpgraded   = "resonator-upgraded"
+	resonatorDowngraded = "resonator-downgraded"
+	modAdded            = "mod-added"
+	modRemoved          = "mod-removed"
+	ownerChanged        = "owner-changed"
+	levelChanged        = "level-changed"
+	healthCrossed       = "health-crossed"
+
+	// Events raised by the arduinos rather than by the portal status
+	buttonPressed = "button-pressed"
+	sensorReading = "sensor-reading"
+)
+
+// portalEvent is a single change in a portal.  The faction is the faction
+// holding the portal after the change, except for destroyed resonators and
+// removed mods where it is the faction that had held them
+//
+type portalEvent struct {
+	Kind        string  `json:"kind"`
+	Portal      string  `json:"portal"`
+	Faction     string  `json:"faction"`
+	PrevFaction string  `json:"prevFaction,omitempty"`
+	Position    string  `json:"position,omitempty"`
+	Level       int     `json:"level,omitempty"`
+	PrevLevel   int     `json:"prevLevel,omitempty"`
+	Owner       string  `json:"owner,omitempty"`
+	PrevOwner   string  `json:"prevOwner,omitempty"`
+	Mod         *mod    `json:"mod,omitempty"`
+	Health      float32 `json:"health,omitempty"`
+	PrevHealth  float32 `json:"prevHealth,omitempty"`
+	Threshold   float32 `json:"threshold,omitempty"`
+	Device      string  `json:"device,omitempty"`
+	Input       string  `json:"input,omitempty"`
+	Value       string  `json:"value,omitempty"`
+}
+
+func (ev *portalEvent) String() string {
+	switch ev.Kind {
+	case factionChanged:
+		return fmt.Sprintf("'%s' %s from %s to %s", ev.Portal, ev.Kind, ev.PrevFaction, ev.Faction)
+	case resonatorDeployed, resonatorDestroyed:
+		return fmt.Sprintf("'%s' %s %s L%d %s (%s)", ev.Portal, ev.Kind, ev.Position, ev.Level, ev.Owner, ev.Faction)
+	case resonatorUpgraded, resonatorDowngraded:
+		return fmt.Sprintf("'%s' %s %s L%d to L%d %s (%s)", ev.Portal, ev.Kind, ev.Position, ev.PrevLevel, ev.Level, ev.Owner, ev.Faction)
+	case modAdded, modRemoved:
+		return fmt.Sprintf("'%s' %s %s %s slot %d", ev.Portal, ev.Kind, ev.Mod.Rarity, ev.Mod.Type, int(ev.Mod.Slot))
+	case ownerChanged:
+		return fmt.Sprintf("'%s' %s from %s to %s", ev.Portal, ev.Kind, ev.PrevOwner, ev.Owner)
+	case levelChanged:
+		return fmt.Sprintf("'%s' %s from L%d to L%d", ev.Portal, ev.Kind, ev.PrevLevel, ev.Level)
+	case healthCrossed:
+		return fmt.Sprintf("'%s' %s %.0f%% from %.0f%% to %.0f%%", ev.Portal, ev.Kind, ev.Threshold, ev.PrevHealth, ev.Health)
+	case buttonPressed:
+		return fmt.Sprintf("'%s' %s %s on %s", ev.Portal, ev.Kind, ev.Input, ev.Device)
+	case sensorReading:
+		return fmt.Sprintf("'%s' %s %s %s on %s", ev.Portal, ev.Kind, ev.Input, ev.Value, ev.Device)
+	}
+	return fmt.Sprintf("'%s' %s", ev.Portal, ev.Kind)
+}
+
+// parseThresholds converts the list of health thresholds into percentages
+//
+func parseThresholds(list string) (thresholds []float32) {
+	thresholds = []float32{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		threshold, err := strconv.ParseFloat(item, 32)
+		if err != nil {
+			logW.Warn(fmt.Sprintf("health threshold '%s' is not a number, ignoring it", item))
+			continue
+		}
+		thresholds = append(thresholds, float32(threshold))
+	}
+	sort.Sort(float32s(thresholds))
+	return thresholds
+}
+
+type float32s []float32
+
+func (f float32s) Len() int           { return len(f) }
+func (f float32s) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f float32s) Less(i, j int) bool { return f[i] < f[j] }
+
+// diffPortal compares two consecutive statuses for a portal and returns the
+// events that explain the differences between them, in the order faction,
+// resonators, mods, owner, level and health
+//
+func diffPortal(prev *portalStatus, cur *portalStatus, thresholds []float32) (events []portalEvent) {
+
+	events = []portalEvent{}
+
+	if prev == nil || cur == nil {
+		return events
+	}
+
+	before := &prev.Status
+	after := &cur.Status
+
+	base := portalEvent{
+		Portal:  after.Title,
+		Faction: after.ControllingFaction,
+	}
+
+	factionChange := before.ControllingFaction != after.ControllingFaction
+	if factionChange {
+		ev := base
+		ev.Kind = factionChanged
+		ev.PrevFaction = before.ControllingFaction
+		events = append(events, ev)
+	}
+
+	// Resonators are matched using their position
+	prevRes := make(map[string]resonator, len(before.Resonators))
+	for _, res := range before.Resonators {
+		prevRes[res.Position] = res
+	}
+	curRes := make(map[string]resonator, len(after.Resonators))
+	for _, res := range after.Resonators {
+		curRes[res.Position] = res
+	}
+
+	destroyed := func(res resonator) {
+		ev := base
+		ev.Kind = resonatorDestroyed
+		ev.Faction = before.ControllingFaction
+		ev.Position = res.Position
+		ev.Level = int(res.Level)
+		ev.Owner = res.Owner
+		events = append(events, ev)
+	}
+	deployed := func(res resonator) {
+		ev := base
+		ev.Kind = resonatorDeployed
+		ev.Position = res.Position
+		ev.Level = int(res.Level)
+		ev.Owner = res.Owner
+		events = append(events, ev)
+	}
+
+	// A portal that has gone neutral can continue to list the resonators it
+	// lost, with no health, until they are cleared.  These were reported as
+	// destroyed when the portal went neutral and are not reported again, nor
+	// are they deployed by the neutral faction
+	wasNeutral := before.ControllingFaction == "Neutral"
+	isNeutral := after.ControllingFaction == "Neutral"
+
+	for _, res := range before.Resonators {
+		if _, ok := curRes[res.Position]; !ok && !wasNeutral {
+			destroyed(res)
+		}
+	}
+	for _, res := range after.Resonators {
+		old, ok := prevRes[res.Position]
+		if !ok {
+			if !isNeutral {
+				deployed(res)
+			}
+			continue
+		}
+		switch {
+		case factionChange:
+			// The resonators of the previous faction must have been
+			// destroyed before the new faction could deploy
+			if !wasNeutral {
+				destroyed(old)
+			}
+			if !isNeutral && res.Health > 0 {
+				deployed(res)
+			}
+		case res.Level > old.Level:
+			ev := base
+			ev.Kind = resonatorUpgraded
+			ev.Position = res.Position
+			ev.Level, ev.PrevLevel = int(res.Level), int(old.Level)
+			ev.Owner, ev.PrevOwner = res.Owner, old.Owner
+			events = append(events, ev)
+		case res.Level < old.Level:
+			ev := base
+			ev.Kind = resonatorDowngraded
+			ev.Position = res.Position
+			ev.Level, ev.PrevLevel = int(res.Level), int(old.Level)
+			ev.Owner, ev.PrevOwner = res.Owner, old.Owner
+			events = append(events, ev)
+		case res.Owner != old.Owner:
+			// Replaced by another agent at the same level
+			destroyed(old)
+			deployed(res)
+		}
+	}
+
+	// Mods are matched using their slot
+	prevMods := make(map[int]mod, len(before.Mods))
+	for _, m := range before.Mods {
+		prevMods[int(m.Slot)] = m
+	}
+	curMods := make(map[int]mod, len(after.Mods))
+	for _, m := range after.Mods {
+		curMods[int(m.Slot)] = m
+	}
+	for _, m := range before.Mods {
+		if cm, ok := curMods[int(m.Slot)]; !ok || cm.Type != m.Type || cm.Rarity != m.Rarity {
+			removed := m
+			ev := base
+			ev.Kind = modRemoved
+			ev.Faction = before.ControllingFaction
+			ev.Mod = &removed
+			events = append(events, ev)
+		}
+	}
+	for _, m := range after.Mods {
+		if pm, ok := prevMods[int(m.Slot)]; !ok || pm.Type != m.Type || pm.Rarity != m.Rarity {
+			added := m
+			ev := base
+			ev.Kind = modAdded
+			ev.Mod = &added
+			ev.Owner = m.Owner
+			events = append(events, ev)
+		}
+	}
+
+	if before.Owner != after.Owner {
+		ev := base
+		ev.Kind = ownerChanged
+		ev.Owner, ev.PrevOwner = after.Owner, before.Owner
+		events = append(events, ev)
+	}
+
+	if int(before.Level) != int(after.Level) {
+		ev := base
+		ev.Kind = levelChanged
+		ev.Level, ev.PrevLevel = int(after.Level), int(before.Level)
+		events = append(events, ev)
+	}
+
+	// Thresholds are reported in the order the health passed them, highest
+	// first as it falls and lowest first as it rises, whatever the order they
+	// were supplied in
+	crossed := float32s{}
+	for _, threshold := range thresholds {
+		if (before.Health < threshold) != (after.Health < threshold) {
+			crossed = append(crossed, threshold)
+		}
+	}
+	if after.Health < before.Health {
+		sort.Sort(sort.Reverse(crossed))
+	} else {
+		sort.Sort(crossed)
+	}
+	for _, threshold := range crossed {
+		ev := base
+		ev.Kind = healthCrossed
+		ev.Health, ev.PrevHealth = after.Health, before.Health
+		ev.Threshold = threshold
+		events = append(events, ev)
+	}
+
+	return events
+}
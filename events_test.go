@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// eventSummary reduces events to their kind along with the detail that
+// distinguishes them
+//
+func eventSummary(events []portalEvent) (summary []string) {
+	summary = []string{}
+	for _, ev := range events {
+		detail := ev.Kind + " " + ev.Faction
+		switch {
+		case len(ev.Position) != 0:
+			detail += " " + ev.Position
+		case ev.Mod != nil:
+			detail += " " + ev.Mod.Type
+		case ev.Threshold != 0:
+			detail += fmt.Sprintf(" %.0f", ev.Threshold)
+		}
+		summary = append(summary, detail)
+	}
+	return summary
+}
+
+func TestDiffPortal(t *testing.T) {
+
+	base := status{
+		Title:              "P",
+		ControllingFaction: "Enlightened",
+		Owner:              "alice",
+		Level:              3,
+		Health:             60,
+		Resonators: []resonator{
+			{Position: "N", Level: 3, Health: 100, Owner: "alice"},
+			{Position: "E", Level: 4, Health: 100, Owner: "bob"},
+		},
+		Mods: []mod{{Slot: 1, Type: "Heat Sink", Rarity: "Rare"}},
+	}
+
+	tests := []struct {
+		name   string
+		change func(after *status)
+		events []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(after *status) {},
+			events: []string{},
+		},
+		{
+			name: "resonators",
+			change: func(after *status) {
+				after.Resonators = []resonator{
+					{Position: "N", Level: 5, Owner: "alice"},
+					{Position: "S", Level: 1, Owner: "carol"},
+				}
+			},
+			events: []string{"resonator-destroyed Enlightened E", "resonator-upgraded Enlightened N", "resonator-deployed Enlightened S"},
+		},
+		{
+			name: "downgraded and replaced",
+			change: func(after *status) {
+				after.Resonators = []resonator{
+					{Position: "N", Level: 2, Owner: "alice"},
+					{Position: "E", Level: 4, Owner: "carol"},
+				}
+			},
+			events: []string{"resonator-downgraded Enlightened N", "resonator-destroyed Enlightened E", "resonator-deployed Enlightened E"},
+		},
+		{
+			// The resonators held over a faction change were destroyed and
+			// redeployed, and are attributed to the faction that held them
+			name: "faction",
+			change: func(after *status) {
+				after.ControllingFaction = "Resistance"
+				after.Resonators = []resonator{{Position: "N", Level: 3, Health: 100, Owner: "alice"}}
+				after.Mods = []mod{}
+			},
+			events: []string{
+				"faction-changed Resistance",
+				"resonator-destroyed Enlightened E",
+				"resonator-destroyed Enlightened N",
+				"resonator-deployed Resistance N",
+				"mod-removed Enlightened Heat Sink",
+			},
+		},
+		{
+			name: "mods",
+			change: func(after *status) {
+				after.Mods = []mod{{Slot: 1, Type: "Heat Sink", Rarity: "Very Rare"}, {Slot: 2, Type: "Force Amp", Rarity: "Rare"}}
+			},
+			events: []string{"mod-removed Enlightened Heat Sink", "mod-added Enlightened Heat Sink", "mod-added Enlightened Force Amp"},
+		},
+		{
+			name: "owner and level",
+			change: func(after *status) {
+				after.Owner = "bob"
+				after.Level = 4.5
+			},
+			events: []string{"owner-changed Enlightened", "level-changed Enlightened"},
+		},
+		{
+			name: "health",
+			change: func(after *status) {
+				after.Health = 20
+			},
+			events: []string{"health-crossed Enlightened 50", "health-crossed Enlightened 25"},
+		},
+	}
+
+	// The events must not depend upon the order the thresholds are supplied in
+	for _, thresholds := range [][]float32{{50, 25}, {25, 50}, parseThresholds("50,25")} {
+		for _, test := range tests {
+			prev := &portalStatus{Status: base}
+			cur := prev.copy()
+			test.change(&cur.Status)
+
+			if events := eventSummary(diffPortal(prev, cur, thresholds)); !reflect.DeepEqual(events, test.events) {
+				t.Errorf("%s %v: expected the events %q, not %q", test.name, thresholds, test.events, events)
+			}
+		}
+
+		if events := diffPortal(nil, &portalStatus{Status: base}, thresholds); len(events) != 0 {
+			t.Errorf("expected no events without a previous status, not %d", len(events))
+		}
+	}
+}
+
+// TestDiffPortalHealth checks the thresholds are reported in the order the
+// health passes them as it falls and as it recovers
+//
+func TestDiffPortalHealth(t *testing.T) {
+
+	low := &portalStatus{Status: status{Title: "P", ControllingFaction: "Resistance", Health: 10}}
+	high := low.copy()
+	high.Status.Health = 90
+
+	for _, thresholds := range [][]float32{{25, 50, 75}, {75, 50, 25}, {50, 75, 25}} {
+		falling := eventSummary(diffPortal(high, low, thresholds))
+		if expected := []string{"health-crossed Resistance 75", "health-crossed Resistance 50", "health-crossed Resistance 25"}; !reflect.DeepEqual(falling, expected) {
+			t.Errorf("%v: expected the events %q as the health fell, not %q", thresholds, expected, falling)
+		}
+		rising := eventSummary(diffPortal(low, high, thresholds))
+		if expected := []string{"health-crossed Resistance 25", "health-crossed Resistance 50", "health-crossed Resistance 75"}; !reflect.DeepEqual(rising, expected) {
+			t.Errorf("%v: expected the events %q as the health rose, not %q", thresholds, expected, rising)
+		}
+	}
+}
+
+// TestDiffPortalDrained plays the XM_drain_all scenario, in which the portal
+// goes neutral with its resonators still listed at no health before they are
+// cleared, and checks each resonator is lost once and none are deployed by
+// the neutral faction
+//
+func TestDiffPortalDrained(t *testing.T) {
+
+	steps, _, err := loadScenario(filepath.Join("simulator", "scenarios", "XM_drain_all"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destroyed := map[string]int{}
+	for i := 1; i < len(steps); i++ {
+		for _, ev := range diffPortal(steps[i-1].status, steps[i].status, nil) {
+			switch ev.Kind {
+			case resonatorDestroyed:
+				if ev.Faction != "Enlightened" {
+					t.Errorf("%s: expected the resonator %s to be lost by the Enlightened, not %s", steps[i].offset, ev.Position, ev.Faction)
+				}
+				destroyed[ev.Position]++
+			case resonatorDeployed:
+				t.Errorf("%s: expected no resonators to be deployed, not %s", steps[i].offset, ev.String())
+			}
+		}
+	}
+
+	if len(destroyed) != 8 {
+		t.Errorf("expected all 8 resonators to be destroyed, not %d", len(destroyed))
+	}
+	for position, count := range destroyed {
+		if count != 1 {
+			t.Errorf("expected the resonator %s to be destroyed once, not %d times", position, count)
+		}
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	if thresholds := parseThresholds("75, 25,bad,50"); !reflect.DeepEqual(thresholds, []float32{25, 50, 75}) {
+		t.Fatalf("expected the thresholds 25, 50 and 75, not %v", thresholds)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+// This module implements the export of portal statuses as a scenario directory
+// that can be served using HttpRoller, or played using a scenario:// URI, and
+// committed as a regression scenario under simulator/scenarios.  Statuses can
+// be exported from a journal recorded using the -record option, or captured
+// from the live sources over a window of time.
+//
+// Only the statuses for a single portal, by default the first of the home
+// portals, are exported.  A status is written to <offset>/module/status/json
+// using the tecthulhu format whenever the portal changes, the offset being
+// the number of seconds from the first status, and a <offset>/finish marker is
+// written at the end.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	exportDir     = flag.String("export", "", "A new scenario directory into which portal statuses are exported, the gateway exits once the export is complete")
+	exportJournal = flag.String("exportJournal", "", "A journal recorded using -record to be exported, when not specified the live sources are exported")
+	exportWindow  = flag.Duration("exportWindow", 5*time.Minute, "The period of time over which the live sources are exported")
+	exportPortal  = flag.String("exportPortal", "", "The portal to be exported, by default the first of the home portals")
+)
+
+type scenarioWriter struct {
+	dir    string
+	portal string
+
+	start      time.Time
+	last       []byte
+	lastOffset int
+	count      int
+}
+
+func newScenarioWriter(dir string, portal string) (writer *scenarioWriter, err error) {
+
+	// Refuse to mix statuses into an existing scenario
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) != 0 {
+		return nil, fmt.Errorf("the scenario directory %s already exists and is not empty", dir)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &scenarioWriter{
+		dir:    dir,
+		portal: portal,
+	}, nil
+}
+
+// add writes the status received at the time indicated when it differs from the
+// previous status written.  Offsets are whole seconds, so a status replaces any
+// written earlier within the same second
+//
+func (writer *scenarioWriter) add(received time.Time, state *portalStatus) (err error) {
+
+	if state.Status.Title != writer.portal {
+		return nil
+	}
+
+	if writer.start.IsZero() {
+		writer.start = received
+	}
+
+	body, err := json.MarshalIndent(tecthulhuStatus(state), "", "    ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(body, writer.last) {
+		return nil
+	}
+
+	offset := int(received.Sub(writer.start) / time.Second)
+	dir := filepath.Join(writer.dir, strconv.Itoa(offset), "module", "status")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "json"), append(body, '\n'), 0644); err != nil {
+		return err
+	}
+
+	if writer.count == 0 || offset != writer.lastOffset {
+		writer.count++
+	}
+	writer.last = body
+	writer.lastOffset = offset
+
+	return nil
+}
+
+// finish writes the marker for the end of the scenario at the time indicated
+//
+func (writer *scenarioWriter) finish(end time.Time) (err error) {
+
+	if writer.count == 0 {
+		return fmt.Errorf("no statuses were found for the portal '%s'", writer.portal)
+	}
+
+	offset := int(end.Sub(writer.start) / time.Second)
+	if offset <= writer.lastOffset {
+		offset = writer.lastOffset + 1
+	}
+
+	dir := filepath.Join(writer.dir, strconv.Itoa(offset))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "finish"), []byte{}, 0644); err != nil {
+		return err
+	}
+
+	logW.Info(fmt.Sprintf("exported %d statuses for '%s' over %d seconds to %s", writer.count, writer.portal, offset, writer.dir))
+	return nil
+}
+
+// exportFromJournal exports the statuses in the journal file without regard
+// to their original timing
+//
+func exportFromJournal(journal string, writer *scenarioWriter) (err error) {
+
+	file, err := os.Open(journal)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	end := time.Time{}
+
+	for line := 1; scanner.Scan(); line++ {
+		entry := &journalEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Status == nil {
+			logW.Warn(fmt.Sprintf("skipping line %d of %s as it is not a journal entry", line, journal))
+			continue
+		}
+		if err = writer.add(entry.Received, entry.Status); err != nil {
+			return err
+		}
+		if entry.Status.Status.Title == writer.portal {
+			end = entry.Received
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	return writer.finish(end)
+}
+
+// exportFromSources exports the statuses arriving from the live sources until
+// the window has elapsed
+//
+func exportFromSources(statusC chan *portalStatus, errorC chan error, window time.Duration, writer *scenarioWriter, quitC chan bool) (err error) {
+
+	logW.Info(fmt.Sprintf("exporting '%s' for %s", writer.portal, window.String()))
+
+	end := time.After(window)
+
+	for {
+		select {
+		case state := <-statusC:
+			if err = writer.add(time.Now(), state); err != nil {
+				return err
+			}
+		case err := <-errorC:
+			logW.Warn(err.Error())
+		case <-end:
+			return writer.finish(time.Now())
+		case <-quitC:
+			return writer.finish(time.Now())
+		}
+	}
+}
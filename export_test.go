@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// journalStatuses writes a journal of the statuses, each received at its
+// offset from the start
+//
+func journalStatuses(t *testing.T, file string, offsets []time.Duration, statuses []*portalStatus) {
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	encoder := json.NewEncoder(out)
+	start := time.Date(2017, 6, 3, 10, 0, 0, 0, time.UTC)
+	for i, state := range statuses {
+		if err = encoder.Encode(&journalEntry{Received: start.Add(offsets[i]), Source: "x", Status: state}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportJournal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	health := func(title string, health float32) *portalStatus {
+		return &portalStatus{Status: status{Title: title, ControllingFaction: "Enlightened", Level: 1, Health: health}}
+	}
+
+	journal := filepath.Join(dir, "journal.jsonl")
+	journalStatuses(t, journal,
+		[]time.Duration{
+			0,
+			300 * time.Millisecond,  // Replaces the first status, in the same second
+			2500 * time.Millisecond, // Written at 2 seconds
+			2700 * time.Millisecond, // Unchanged
+			4 * time.Second,         // Another portal
+		},
+		[]*portalStatus{health("P", 100), health("P", 90), health("P", 80), health("P", 80), health("Q", 10)})
+
+	scenDir := filepath.Join(dir, "scenario")
+	writer, err := newScenarioWriter(scenDir, "P")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = exportFromJournal(journal, writer); err != nil {
+		t.Fatal(err)
+	}
+	if writer.count != 2 {
+		t.Errorf("expected 2 statuses to be exported, not %d", writer.count)
+	}
+
+	steps, finish, err := loadScenario(scenDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[0].offset != 0 || steps[1].offset != 2*time.Second {
+		t.Fatalf("expected statuses at 0s and 2s, not %d statuses", len(steps))
+	}
+	if steps[0].status.Status.Health != 90 || steps[1].status.Status.Health != 80 {
+		t.Errorf("expected the health 90 and then 80, not %.0f and %.0f", steps[0].status.Status.Health, steps[1].status.Status.Health)
+	}
+	// The last status for the portal was received within the second of
+	// the last status written, the finish marker follows it
+	if finish != 3*time.Second {
+		t.Errorf("expected the scenario to finish at 3s, not %s", finish)
+	}
+	if _, err = os.Stat(filepath.Join(scenDir, "3", "finish")); err != nil {
+		t.Error(err)
+	}
+
+	// An export never mixes statuses into an existing scenario
+	if _, err = newScenarioWriter(scenDir, "P"); err == nil {
+		t.Error("expected the existing scenario to be refused")
+	}
+
+	// A portal that is not in the journal cannot be exported
+	writer, err = newScenarioWriter(filepath.Join(dir, "missing"), "R")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = exportFromJournal(journal, writer); err == nil {
+		t.Error("expected an export without statuses to fail")
+	}
+}
+
+func TestExportScenario(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A scenario recorded as a journal and exported again is unchanged,
+	// other than losing any statuses that repeat the one before
+	original, _, err := loadScenario(filepath.Join("simulator", "scenarios", "XM_drain_all"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := []time.Duration{}
+	statuses := []*portalStatus{}
+	for _, step := range original {
+		offsets = append(offsets, step.offset)
+		statuses = append(statuses, step.status)
+	}
+	journal := filepath.Join(dir, "journal.jsonl")
+	journalStatuses(t, journal, offsets, statuses)
+
+	scenDir := filepath.Join(dir, "scenario")
+	writer, err := newScenarioWriter(scenDir, original[0].status.Status.Title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = exportFromJournal(journal, writer); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, finish, err := loadScenario(scenDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) == 0 || finish <= exported[len(exported)-1].offset {
+		t.Fatalf("expected the exported scenario to finish after its statuses, not at %s", finish)
+	}
+
+	i := 0
+	for _, step := range original {
+		if i < len(exported) && exported[i].offset == step.offset {
+			if !reflect.DeepEqual(exported[i].status.Status, step.status.Status) {
+				t.Errorf("%s: expected %+v, not %+v", step.offset, step.status.Status, exported[i].status.Status)
+			}
+			i++
+			continue
+		}
+		if i == 0 || !reflect.DeepEqual(exported[i-1].status.Status, step.status.Status) {
+			t.Errorf("%s: expected the status to be exported", step.offset)
+		}
+	}
+	if i != len(exported) {
+		t.Errorf("expected %d statuses to be exported, not %d", i, len(exported))
+	}
+}
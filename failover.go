@@ -0,0 +1,232 @@
+package main
+
+// This module implements failover between the sources of portal status
+// information.  Sources are listed in order of preference, for example a
+// concentrator followed by the tecthulhus, and the health of each is
+// tracked using the statuses and errors that it reports.  For each portal
+// only the statuses from the most preferred healthy source reporting on that
+// portal are passed to the gateway.  When that source becomes unhealthy the
+// next healthy source is used, and once a more preferred source has been
+// healthy for long enough the gateway fails back to it.
+//
+// Sources that push updates only report when a portal changes, so a source is
+// also kept from going stale by the signs of life that it records using
+// publishAlive, such as WebSocket pongs or MQTT keepalives.  When the gateway
+// switches source for a portal the last status from the new source is passed
+// on straight away.
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var (
+	failbackAfter = flag.Duration("failback", time.Minute, "How long a preferred source of portal status must be healthy before it is used again")
+	staleAfter    = flag.Duration("staleAfter", 10*time.Second, "How long a source of portal status can go without reporting before it is considered unhealthy")
+)
+
+const (
+	// The weight given to the most recent result when scoring the
+	// health of a source
+	healthWeight = 0.3
+
+	// Sources scoring below this value are considered unhealthy
+	healthThreshold = 0.5
+)
+
+type sourceHealth struct {
+	url      string
+	priority int
+
+	// An exponentially weighted average of the results of retrieving status
+	// from the source, 1.0 for success and 0.0 for failure
+	score        float64
+	lastSeen     time.Time
+	healthySince time.Time
+
+	// The portals that the source has reported on, and the last status it
+	// reported for each
+	titles map[string]bool
+	latest map[string]*portalStatus
+}
+
+func (health *sourceHealth) healthy(now time.Time) bool {
+	return health.score >= healthThreshold && now.Sub(health.lastSeen) < *staleAfter
+}
+
+type sourceError struct {
+	source *sourceHealth
+	err    error
+}
+
+type failover struct {
+	sources []*sourceHealth
+	bySrc   map[string]*sourceHealth
+
+	// The source currently being used for each portal
+	active map[string]*sourceHealth
+
+	errC chan sourceError
+}
+
+func newFailover() (fo *failover) {
+	return &failover{
+		sources: []*sourceHealth{},
+		bySrc:   map[string]*sourceHealth{},
+		active:  map[string]*sourceHealth{},
+		errC:    make(chan sourceError, 1),
+	}
+}
+
+// add registers a source, sources are preferred in the order they are added.
+// The errors reported by the source are used to score its health
+//
+func (fo *failover) add(uri string, errorC chan error, quitC chan bool) {
+	health := &sourceHealth{
+		url:      uri,
+		priority: len(fo.sources),
+		titles:   map[string]bool{},
+		latest:   map[string]*portalStatus{},
+	}
+	fo.sources = append(fo.sources, health)
+	fo.bySrc[uri] = health
+
+	go func() {
+		for {
+			select {
+			case err := <-errorC:
+				select {
+				case fo.errC <- sourceError{source: health, err: err}:
+				case <-quitC:
+					return
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// run passes the statuses from the active sources to the gateway using
+// statusC until the quitC channel is closed
+//
+func (fo *failover) run(inC chan *portalStatus, statusC chan *portalStatus, errorC chan error, quitC chan bool) {
+
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+
+	for {
+		select {
+		case state := <-inC:
+			health, ok := fo.bySrc[state.Source]
+			if !ok {
+				continue
+			}
+			health.score = health.score*(1-healthWeight) + healthWeight
+			health.lastSeen = time.Now()
+			health.titles[state.Status.Title] = true
+			health.latest[state.Status.Title] = state
+
+			previous := fo.active[state.Status.Title]
+			fo.evaluate(time.Now(), statusC, errorC)
+
+			// A source that has just been switched to has already had
+			// its latest status passed on
+			if active := fo.active[state.Status.Title]; active == health && (previous == nil || previous == health) {
+				publishStatus(state.Source, state, statusC, errorC)
+			}
+
+		case srcErr := <-fo.errC:
+			srcErr.source.score *= 1 - healthWeight
+			publishError(srcErr.err, errorC)
+
+			fo.evaluate(time.Now(), statusC, errorC)
+
+		case <-check.C:
+			fo.evaluate(time.Now(), statusC, errorC)
+
+		case <-quitC:
+			return
+		}
+	}
+}
+
+// evaluate chooses the source to be used for each portal, passing on the last
+// status from a newly chosen source
+//
+func (fo *failover) evaluate(now time.Time, statusC chan *portalStatus, errorC chan error) {
+
+	titles := map[string]bool{}
+	for _, health := range fo.sources {
+		if alive := lastAlive(health.url); alive.After(health.lastSeen) {
+			health.lastSeen = alive
+		}
+		if !health.healthy(now) {
+			health.healthySince = time.Time{}
+		} else if health.healthySince.IsZero() {
+			health.healthySince = now
+		}
+		for title := range health.titles {
+			titles[title] = true
+		}
+	}
+
+	for title := range titles {
+		active := fo.active[title]
+
+		var chosen *sourceHealth
+		reason := ""
+
+		for _, health := range fo.sources {
+			if !health.titles[title] || !health.healthy(now) {
+				continue
+			}
+			if active == nil {
+				chosen, reason = health, "initial source"
+				break
+			}
+			if health == active {
+				break
+			}
+			if !active.healthy(now) {
+				chosen, reason = health, fmt.Sprintf("%s is unhealthy", active.url)
+				break
+			}
+			if health.priority < active.priority && now.Sub(health.healthySince) >= *failbackAfter {
+				chosen, reason = health, fmt.Sprintf("%s has been healthy for %s", health.url, now.Sub(health.healthySince).String())
+				break
+			}
+		}
+
+		// Until any source is healthy use the first one to report
+		// on the portal rather than having no data
+		if active == nil && chosen == nil {
+			for _, health := range fo.sources {
+				if health.titles[title] {
+					chosen, reason = health, "initial source"
+					break
+				}
+			}
+		}
+
+		if chosen == nil || chosen == active {
+			continue
+		}
+
+		fo.active[title] = chosen
+
+		if latest := chosen.latest[title]; latest != nil && active != nil {
+			publishStatus(chosen.url, latest, statusC, errorC)
+		}
+
+		if active == nil {
+			logW.Info(fmt.Sprintf("portal '%s' using %s, %s", title, chosen.url, reason))
+			continue
+		}
+
+		err := fmt.Errorf("portal '%s' switched from %s (score %.2f) to %s (score %.2f), %s", title, active.url, active.score, chosen.url, chosen.score, reason)
+		logW.Info(err.Error())
+		publishError(err, errorC)
+	}
+}
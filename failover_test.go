@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failoverSources returns a failover with a preferred and a backup source
+// that have both reported on the portal, the preferred source being in use.
+// The sources are named after the portal as their liveness is shared
+//
+func failoverSources(title string) (fo *failover, preferred *sourceHealth, backup *sourceHealth) {
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	fo = newFailover()
+	fo.add("ws://preferred/"+title, make(chan error), quitC)
+	fo.add("http://backup/"+title, make(chan error), quitC)
+
+	now := time.Now()
+	for _, health := range fo.sources {
+		health.score = 1
+		health.lastSeen = now
+		health.titles[title] = true
+		health.latest[title] = &portalStatus{Status: status{Title: title}, Source: health.url}
+	}
+	preferred, backup = fo.sources[0], fo.sources[1]
+	fo.active[title] = preferred
+	return fo, preferred, backup
+}
+
+func TestFailoverAlive(t *testing.T) {
+
+	fo, preferred, _ := failoverSources("P")
+	statusC := make(chan *portalStatus, 1)
+	errorC := make(chan error, 10)
+
+	// The preferred source has had nothing to report for a while, but its
+	// stream shows it is still up
+	preferred.lastSeen = time.Now().Add(-2 * *staleAfter)
+	publishAlive(preferred.url)
+
+	fo.evaluate(time.Now(), statusC, errorC)
+	if fo.active["P"] != preferred {
+		t.Fatalf("expected the quiet but live source to be kept, not %s", fo.active["P"].url)
+	}
+	select {
+	case state := <-statusC:
+		t.Fatalf("expected nothing to be passed on, not a status from %s", state.Source)
+	default:
+	}
+}
+
+func TestFailoverStale(t *testing.T) {
+
+	fo, preferred, backup := failoverSources("Q")
+	statusC := make(chan *portalStatus, 1)
+	errorC := make(chan error, 10)
+
+	preferred.lastSeen = time.Now().Add(-2 * *staleAfter)
+
+	fo.evaluate(time.Now(), statusC, errorC)
+	if fo.active["Q"] != backup {
+		t.Fatalf("expected the stale source to be replaced by %s, not %s", backup.url, fo.active["Q"].url)
+	}
+
+	// The backup's last status is passed on at once rather than waiting for
+	// it to next report
+	select {
+	case state := <-statusC:
+		if state.Source != backup.url {
+			t.Fatalf("expected the status from %s, not %s", backup.url, state.Source)
+		}
+	default:
+		t.Fatal("the status from the new source was not passed on")
+	}
+}
+
+func TestFailoverSerial(t *testing.T) {
+
+	master, slave := openPty(t)
+	defer master.Close()
+
+	dir, err := ioutil.TempDir("", "failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, "tty")
+	if err = os.Symlink(slave, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// The URI differs from the form url.URL gives it, the statuses from the
+	// device must still be matched to the source
+	uri := "Serial://" + link + "?baud=115200"
+
+	inC := make(chan *portalStatus, 10)
+	statusC := make(chan *portalStatus, 10)
+	errorC := make(chan error, 10)
+	srcErrorC := make(chan error, 10)
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	source, err := newSource(uri, false, inC, srcErrorC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo := newFailover()
+	fo.add(uri, srcErrorC, quitC)
+	go fo.run(inC, statusC, errorC, quitC)
+	go source.startPortals(quitC)
+
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(10 * time.Second)
+
+	line := []byte("{\"status\":{\"title\":\"A\",\"controllingFaction\":\"1\"}}\n")
+	for {
+		select {
+		case state := <-statusC:
+			if state.Status.Title != "A" || state.Source != uri {
+				t.Fatalf("expected the status of 'A' from %s, not '%s' from %s", uri, state.Status.Title, state.Source)
+			}
+			return
+		case <-tick.C:
+			master.Write(line)
+		case <-timeout:
+			t.Fatal("the status from the serial device was not passed on")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+// This module implements version 2 of the protocol used to send lines to the
+// arduinos.  Version 2 frames each line with a sequence number and a CRC, and
+// the arduino acknowledges every frame it receives.  Frames that are not
+// acknowledged in time, or that the arduino reports as damaged, are sent again
+// up to a limit after which the device is taken offline.
+//
+// Devices opt in to version 2 by adding ' proto=2' to the end of the role they
+// report when pinged, for example 'Magnus Resonators Node proto=2'.  Devices
+// reporting only their role continue to receive unframed version 1 lines.
+//
+// A frame takes the form,
+//
+//   ~SSCCCC<line>\n
+//
+// where SS is the sequence number as two hex digits, incrementing for every
+// new line and wrapping after ff, and CCCC is the CRC-16/CCITT-FALSE of the
+// sequence number digits and the line as four hex digits.  Hex digits are in
+// uppercase.  The arduino replies with 'ACK SS' once it has a frame with a
+// good CRC, or 'NAK SS' should the CRC be wrong.
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ackTimeout = flag.Duration("ackTimeout", 500*time.Millisecond, "The time allowed for an arduino using protocol version 2 to acknowledge a line")
+	ackRetries = flag.Int("ackRetries", 3, "The number of times a line is sent again to an arduino using protocol version 2 before the device is taken offline")
+)
+
+const protoOption = "proto="
+
+// frameAck is an acknowledgement received from a device
+//
+type frameAck struct {
+	seq byte
+	ok  bool
+}
+
+// parseRole separates the role reported by a device from the protocol
+// version it has asked for
+//
+func parseRole(reply string) (role string, proto int) {
+
+	fields := strings.Fields(reply)
+	if len(fields) != 0 {
+		last := strings.ToLower(fields[len(fields)-1])
+		if strings.HasPrefix(last, protoOption) {
+			if version, err := strconv.Atoi(last[len(protoOption):]); err == nil {
+				return strings.Join(fields[:len(fields)-1], " "), version
+			}
+		}
+	}
+	return reply, 1
+}
+
+// crc16 returns the CRC-16/CCITT-FALSE of the data
+//
+func crc16(data []byte) (crc uint16) {
+	crc = 0xffff
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// frame wraps a line, without its terminator, in a version 2 frame
+//
+func frame(seq byte, line []byte) (framed []byte) {
+	seqHex := fmt.Sprintf("%02X", seq)
+	crc := crc16(append([]byte(seqHex), line...))
+
+	framed = make([]byte, 0, len(line)+8)
+	framed = append(framed, '~')
+	framed = append(framed, seqHex...)
+	framed = append(framed, fmt.Sprintf("%04X", crc)...)
+	framed = append(framed, line...)
+	return append(framed, '\n')
+}
+
+// parseAck decodes the sequence number from an ACK or NAK message
+//
+func parseAck(text string, ok bool) (ack *frameAck, err error) {
+	seq, err := strconv.ParseUint(strings.TrimSpace(text), 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("bad sequence number '%s'", text)
+	}
+	return &frameAck{seq: byte(seq), ok: ok}, nil
+}
+
+// sendFrame sends the line to the device as a version 2 frame, waiting for the
+// device to acknowledge it and sending it again when it is not
+//
+func (dev *arduino) sendFrame(cmd []byte) (err error) {
+
+	dev.seq++
+	framed := frame(dev.seq, []byte(strings.TrimRight(string(cmd), "\r\n")))
+
+	// Forget acknowledgements for earlier frames that arrived late
+	for drained := false; !drained; {
+		select {
+		case <-dev.acks:
+		default:
+			drained = true
+		}
+	}
+
+	for attempt := 0; attempt <= *ackRetries; attempt++ {
+		if attempt != 0 {
+			logW.Debug(fmt.Sprintf("resending frame %02X to %s, attempt %d", dev.seq, dev.devName, attempt+1))
+		}
+		if err = dev.write(framed); err != nil {
+			return err
+		}
+
+		timeout := time.After(*ackTimeout)
+		for waiting := true; waiting; {
+			select {
+			case ack := <-dev.acks:
+				if ack.seq != dev.seq {
+					continue
+				}
+				if ack.ok {
+					return nil
+				}
+				waiting = false
+			case <-timeout:
+				waiting = false
+			}
+		}
+	}
+	return fmt.Errorf("frame %02X was not acknowledged after %d attempts", dev.seq, *ackRetries+1)
+}
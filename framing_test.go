@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	// The check value for CRC-16/CCITT-FALSE
+	if crc := crc16([]byte("123456789")); crc != 0x29B1 {
+		t.Fatalf("expected the CRC 29B1, not %04X", crc)
+	}
+	if crc := crc16([]byte{}); crc != 0xffff {
+		t.Fatalf("expected the CRC of nothing to be FFFF, not %04X", crc)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		seq   byte
+		line  string
+		frame string
+	}{
+		{seq: 0x0a, line: "e10800500", frame: "~0AFE26e10800500\n"},
+		{seq: 0xff, line: "", frame: "~FF9267\n"},
+	}
+	for _, test := range tests {
+		if framed := string(frame(test.seq, []byte(test.line))); framed != test.frame {
+			t.Errorf("expected %q, not %q", test.frame, framed)
+		}
+	}
+}
+
+func TestParseAck(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+		seq  byte
+		err  bool
+	}{
+		{text: "0A", ok: true, seq: 0x0a},
+		{text: " ff\r", ok: false, seq: 0xff},
+		{text: "100", err: true},
+		{text: "", err: true},
+		{text: "zz", err: true},
+	}
+	for _, test := range tests {
+		ack, err := parseAck(test.text, test.ok)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("expected %q to be rejected", test.text)
+		case !test.err && err != nil:
+			t.Errorf("expected %q to be accepted, not %s", test.text, err.Error())
+		case !test.err && (ack.seq != test.seq || ack.ok != test.ok):
+			t.Errorf("expected %q to be %02X %t, not %02X %t", test.text, test.seq, test.ok, ack.seq, ack.ok)
+		}
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		reply string
+		role  string
+		proto int
+	}{
+		{reply: "Magnus Resonators Node proto=2", role: "Magnus Resonators Node", proto: 2},
+		{reply: "Magnus Resonators Node PROTO=2", role: "Magnus Resonators Node", proto: 2},
+		{reply: "Magnus Resonators Node", role: "Magnus Resonators Node", proto: 1},
+		{reply: "Magnus Core proto=x", role: "Magnus Core proto=x", proto: 1},
+		{reply: "", role: "", proto: 1},
+	}
+	for _, test := range tests {
+		if role, proto := parseRole(test.reply); role != test.role || proto != test.proto {
+			t.Errorf("expected %q to be '%s' version %d, not '%s' version %d", test.reply, test.role, test.proto, role, proto)
+		}
+	}
+}
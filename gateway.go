@@ -5,13 +5,16 @@ package main
 // the gateway
 //
 import (
+	"flag"
 	"fmt"
-	"strconv"
 	"sync"
 	"time"
 )
 
 var (
+	debounce  = flag.Duration("debounce", 250*time.Millisecond, "The minimum time between sending changes in the portal to the arduinos, changes arriving sooner are combined")
+	keepalive = flag.Duration("keepalive", 10*time.Second, "The time after which an unchanged portal is sent to the arduinos again, covering arduinos that have been reset")
+
 	// Record the last known state of a portal in order that transitions can be discovered
 	// and a diff can be sent to the arduino so that it does not have to track changes
 	// in alignment etc
@@ -19,29 +22,95 @@ var (
 	lastState = map[string]*portalStatus{}
 )
 
-func encodePercent(v int) byte {
-	if v == 0 {
-		return ' '
-	}
-	return byte(int(' ') + (v / 2))
+// lastStatus holds the most recent status received for each portal, indexed
+// by the portal title
+//
+type lastStatus struct {
+	statuses map[string]*portalStatus
+	sync.Mutex
 }
 
-type lastStatus struct {
-	status *portalStatus
+// deviceSent records the last line written to a device, when it was
+// written and the line waiting to be written, if any.  The change of faction
+// and the lines from the rules are held for the device until they have been
+// written to it
+//
+type deviceSent struct {
+	line   string
+	at     time.Time
+	queued string
+
+	faction bool
+	lines   [][]byte
+}
+
+// sentLines holds what has been sent to each of the devices of a portal,
+// indexed by the identity of the device.  It is updated by the writers of
+// the devices as the lines are written
+//
+type sentLines struct {
+	devices map[string]*deviceSent
 	sync.Mutex
 }
 
-func startGateway(homePortal string, tectC chan *portalStatus, ambientC chan<- string, sfxC chan<- []string, quitC chan bool) {
+// homePortal is a portal that is being driven by this gateway, each home
+// portal has its own set of arduinos and its own audio channels
+//
+type homePortal struct {
+	name string
+
+	// AUdio comes with 2 mixed channels of audio, ambientC is a looped
+	// playback that will interrupt ambient playback as a new file name
+	// is recieved, and sfxC is a single effect that will interrupt
+	// any other playing sfx file
+	ambientC chan string
+	sfxC     chan []string
 
 	// Used to trigger a manual update for the ambient noise effects
-	forceAmbient := false
+	forceAmbient bool
+
+	// The portal health percentages that generate events when crossed
+	thresholds []float32
+
+	// The rules mapping the events of the portal to sounds and arduino lines
+	rules *ruleBook
+
+	// Optionally used to publish changes in the portal
+	mqtt *mqttSink
+
+	// Tracks the activity of the agents on the portal
+	board *leaderboard
+
+	// When changes were last sent, and what has been sent to each device
+	changedAt time.Time
+	sent      sentLines
 
-	// Used to track the addition and reduction in the number of resonators
-	resCount := 0
+	// Used to have the gateway send changes delayed by the debounce
+	wakeupC chan bool
+}
+
+func newHomePortal(name string) (home *homePortal) {
+	return &homePortal{
+		name:       name,
+		ambientC:   make(chan string, 1),
+		sfxC:       make(chan []string, 1),
+		thresholds: parseThresholds(*healthThresholds),
+		sent: sentLines{
+			devices: map[string]*deviceSent{},
+		},
+	}
+}
+
+func startGateway(homes []*homePortal, tectC chan *portalStatus, quitC chan bool) {
 
 	// Track arriving status information
 	status := lastStatus{
-		status: nil,
+		statuses: map[string]*portalStatus{},
+	}
+
+	isHome := make(map[string]bool, len(homes))
+	for _, home := range homes {
+		isHome[home.name] = true
 	}
 
 	// Time for push changes to the arduinos indepedently of the portal
@@ -49,204 +118,343 @@ func startGateway(homePortal string, tectC chan *portalStatus, ambientC chan<- s
 	refresh := time.NewTicker(2 * time.Second)
 	defer refresh.Stop()
 
-	go func () {
+	// Used to process fresh statuses as soon as they arrive rather than
+	// waiting for the next refresh
+	wakeupC := make(chan bool, 1)
+	for _, home := range homes {
+		home.wakeupC = wakeupC
+	}
+
+	go func() {
+		// Remember the portals that have been reported that are not
+		// ones we are driving so that they are only logged once
+		ignored := map[string]bool{}
+
 		for {
 			select {
 			case state := <-tectC:
+				if !isHome[state.Status.Title] {
+					if !ignored[state.Status.Title] {
+						ignored[state.Status.Title] = true
+						logW.Warn(fmt.Sprintf("none of the home portals matched the data from %s for '%s', ignoring it", state.Source, state.Status.Title))
+					}
+					continue
+				}
 				status.Lock()
-				status.status = state
+				status.statuses[state.Status.Title] = state
 				status.Unlock()
+
+				select {
+				case wakeupC <- true:
+				default:
+				}
 			case <-quitC:
 				return
 			}
 		}
 	}()
- 
+
+	homesByName := make(map[string]*homePortal, len(homes))
+	for _, home := range homes {
+		homesByName[home.name] = home
+	}
+
 	for {
 		select {
 		case <-refresh.C:
+		case <-wakeupC:
+		case ev := <-deviceEventC:
+			if home, ok := homesByName[ev.Portal]; ok {
+				home.deviceEvent(&ev)
+			}
+			continue
+		case <-quitC:
+			return
+		}
+
+		for _, home := range homes {
 			status.Lock()
-			state := status.status
+			state := status.statuses[home.name]
 			status.Unlock()
 
 			if state == nil {
-				logW.Trace("no data")
+				logW.Trace(fmt.Sprintf("no data for %s", home.name))
 				continue
 			}
 
-			if homePortal != state.Status.Title {
-				logW.Warn(fmt.Sprintf("home portal '%s' did not match the data from Niantic '%s'", homePortal, state.Status.Title))
-				continue
-			}
+			home.update(state)
+		}
+	}
+}
 
-			// If there is not history add the fresh state as the previous state
-			//
-			if _, ok := lastState[state.Status.Title]; !ok {
-				lastState[state.Status.Title] = state
-				forceAmbient = true
-			}
+// update processes the latest state of the home portal, generating audio
+// and sending the state to the arduinos associated with the portal
+//
+func (home *homePortal) update(state *portalStatus) {
 
-			// Sounds effects that are gathered as a result of state
-			// and played back later
-			sfxs := []string{}
+	// If there is not history add the fresh state as the previous state
+	//
+	if _, ok := lastState[state.Status.Title]; !ok {
+		lastState[state.Status.Title] = state
+		home.forceAmbient = true
+	}
 
-			factionChange := lastState[state.Status.Title].Status.ControllingFaction != state.Status.ControllingFaction
+	// Discover what has changed since the last state
+	events := diffPortal(lastState[state.Status.Title], state, home.thresholds)
 
-			if factionChange {
+	factionChange := false
 
-				if resCount != 0 {
-					// Trigger the res destroyed audio for the last faction to
-					// own the portal
-					resCount = 0
-				}
-				// e-loss, r-loss, n-loss
-				switch lastState[state.Status.Title].Status.ControllingFaction {
-				case "Neutral":
-					sfxs = append(sfxs, "n-loss")
-				case "Enlightened":
-					sfxs = append(sfxs, "e-loss")
-				case "Resistance":
-					sfxs = append(sfxs, "r-loss")
-				default:
-					logW.Warn(fmt.Sprintf("unknown faction '%s'", state.Status.ControllingFaction))
-				}
-				switch state.Status.ControllingFaction {
-				case "Neutral":
-					sfxs = append(sfxs, "n-capture")
-				case "Enlightened":
-					sfxs = append(sfxs, "e-capture")
-				case "Resistance":
-					sfxs = append(sfxs, "r-capture")
-				default:
-					logW.Warn(fmt.Sprintf("unknown faction '%s'", state.Status.ControllingFaction))
-				}
-			} else {
-				// If the new state was not a change of faction did the number
-				// of resonators change
-			}
+	for _, ev := range events {
+		logW.Info(ev.String())
 
-			if factionChange || forceAmbient {
-				ambient := ""
-				switch state.Status.ControllingFaction {
-				case "Neutral":
-					ambient = "n-ambient"
-				case "Enlightened":
-					ambient = "e-ambient"
-				case "Resistance":
-					ambient = "r-ambient"
-				default:
-					logW.Warn(fmt.Sprintf("unknown faction '%s'", state.Status.ControllingFaction))
-				}
-				forceAmbient = false
-				go func() {
-					select {
-					case ambientC <- ambient:
-					case <-time.After(time.Second):
-					}
-				}()
-			}
+		if home.mqtt != nil {
+			home.mqtt.publishEvent(&ev)
+		}
 
-			// Check for sound effects that need to be played
-			if len(sfxs) != 0 {
-				go func() {
-					select {
-					case sfxC <- sfxs:
-					case <-time.After(time.Second):
-					}
-				}()
-			}
-			// Process the state updates into arduino CMDs and then send these to
-			// the arduinos that are listening and our associated with the home portal
-			// in any functional capacity
-			cmd := make([]byte, 0, 32)
-			switch state.Status.ControllingFaction {
-			case "Neutral":
-				if factionChange {
-					cmd = append(cmd, 'N')
-				} else {
-					cmd = append(cmd, 'n')
-				}
-			case "Enlightened":
-				if factionChange {
-					cmd = append(cmd, 'E')
-				} else {
-					cmd = append(cmd, 'e')
-				}
-			case "Resistance":
-				if factionChange {
-					cmd = append(cmd, 'R')
-				} else {
-					cmd = append(cmd, 'r')
-				}
-			}
+		if ev.Kind == factionChanged {
+			factionChange = true
+		}
+	}
 
-			// Now dump out resonator levels, one character for each, and record the health values
-			resCmd := []byte{'0', '0', '0', '0', '0', '0', '0', '0'}
-			// Health values are encoded percentages, space for 0%
-			resHealth := []byte{' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
-			// Translate an ascii compass point to a position in the resonators array
-			resPositionMap := map[string]int{"N": 2, "NE": 1, "E": 0, "SE": 7, "S": 6, "SW": 5, "W": 4, "NW": 3}
-
-			for _, res := range state.Status.Resonators {
-				if position, ok := resPositionMap[res.Position]; ok {
-					// After we have the position set the character in the resCmd for that
-					// position to the single ASCII digit the represents the level of the
-					// resonator
-					resCmd[position] = strconv.Itoa(int(res.Level))[0]
-					resHealth[position] = encodePercent(int(res.Health))
-				}
+	if home.board != nil {
+		home.board.record(events, state)
+	}
+
+	rules := home.rules.current()
+
+	// Sounds effects, and any extra arduino lines, that are gathered
+	// as a result of state and played back later
+	actions := rules.apply(events, state)
+	sfxs := actions.sfxs
+
+	if factionChange || home.forceAmbient {
+		ambient := rules.apply([]portalEvent{{
+			Kind:    ambientNeeded,
+			Portal:  state.Status.Title,
+			Faction: state.Status.ControllingFaction,
+		}}, state).ambient
+		if len(ambient) == 0 {
+			logW.Warn(fmt.Sprintf("no rule chose an ambient track for '%s' held by %s", state.Status.Title, state.Status.ControllingFaction))
+		}
+		home.forceAmbient = false
+		go func() {
+			select {
+			case home.ambientC <- ambient:
+			case <-time.After(time.Second):
 			}
+		}()
+	}
 
-			cmd = append(cmd, resCmd...)
-			cmd = append(cmd, encodePercent(int(state.Status.Health)))
-			cmd = append(cmd, resHealth...)
-
-			// Mods array handling
-			mods := []byte{' ', ' ', ' ', ' '}
-			modsMap := map[string]byte{"FA": '0', "HS-C": '1',
-				"HS-R": '2', "HS-VR": '3', "LA-R ": '4', "LA-VR": '5',
-				"SBUL": '6', "MH-C": '7', "MH-R": '8', "MH-VR": '9',
-				"PS-C": 'A', "PS-R": 'B', "PS-VR": 'C', "AXA": 'D',
-				"T": 'E'}
-			for i, mod := range state.Status.Mods {
-				if code, ok := modsMap[mod.Type]; ok {
-					mods[i] = code
-				}
+	// Check for sound effects that need to be played
+	if len(sfxs) != 0 {
+		go func() {
+			select {
+			case home.sfxC <- sfxs:
+			case <-time.After(time.Second):
 			}
-			cmd = append(cmd, mods...)
+		}()
+	}
+	if home.mqtt != nil {
+		home.mqtt.publishState(state)
+		home.mqtt.publishCommand(home.name, encodeStatus(state, factionChange))
+	}
 
-			// After printing the overall health output the per resonator health wih delimiters
-			cmd = append(cmd, '\n')
+	home.refresh(state, factionChange, actions.lines)
 
-			devices := getRunningDevices(homePortal)
-			logW.Trace(fmt.Sprintf("sending data to %d devices", len(devices)))
+	// Save the new state as the last known state
+	lastState[state.Status.Title] = state
+}
 
-			devicesSent := []string{}
+// refresh sends the state to the arduinos of the portal, along with any
+// change of faction and lines from the rules.  Devices are sent their line
+// as soon as it changes, unless a change was sent within the debounce period
+// in which case the send is delayed until the period is over.  Devices whose
+// line has not changed are sent it again once the keepalive period has
+// passed.  A change of faction is shown using an uppercase faction until the
+// line showing it has been written, after which the lowercase line is a
+// change of its own
+//
+func (home *homePortal) refresh(state *portalStatus, factionChange bool, extra [][]byte) {
 
-			for _, device := range devices {
-				func() {
+	now := time.Now()
+	devices := getRunningDevices(home.name)
 
-					defer func() {
-						if nil != recover() {
-							stopRunningDevice(homePortal, device.devName)
-						}
-					}()
+	// The lines sent are unlocked before the devices are sent their lines
+	// as a device reports back at once when it drops lines
+	home.sent.Lock()
 
-					if err := device.sendCmd(cmd); err != nil {
-						logW.Warn(fmt.Sprintf("%q ➡  device %s role '%s' got an error %s, taking device offline", cmd, device.devName, device.role, err.Error()))
-						stopRunningDevice(homePortal, device.devName)
-						return
-					}
-					devicesSent = append(devicesSent, device.devName)
-				}()
-			}
-			logW.Info(fmt.Sprintf("%q ➡ %v", cmd, devicesSent))
+	// Forget the devices that have gone away so that they are sent
+	// their line should they return, changes are not held for devices
+	// that might be plugged in later
+	for key := range home.sent.devices {
+		if _, ok := devices[key]; !ok {
+			delete(home.sent.devices, key)
+		}
+	}
+	for key := range devices {
+		sent, ok := home.sent.devices[key]
+		if !ok {
+			sent = &deviceSent{}
+			home.sent.devices[key] = sent
+		}
+		if factionChange {
+			sent.faction = true
+		}
+		sent.lines = append(sent.lines, extra...)
+	}
 
-			// Save the new state as the last known state
-			lastState[state.Status.Title] = state
+	// Each device is sent the line for its own role
+	lines := map[string][]byte{}
+	lineFor := func(device *arduino, faction bool) []byte {
+		encoder := encoderFor(device.role)
+		name := fmt.Sprintf("%s %t", encoder.name, faction)
+		line, ok := lines[name]
+		if !ok {
+			line = encoder.encode(state, faction)
+			lines[name] = line
+		}
+		return line
+	}
 
-		case <-quitC:
+	// Devices are compared with the line waiting to be written to them,
+	// or otherwise the last line written
+	latest := func(sent *deviceSent) string {
+		if len(sent.queued) != 0 {
+			return sent.queued
+		}
+		return sent.line
+	}
+
+	changed := false
+	for key, device := range devices {
+		sent := home.sent.devices[key]
+		if len(sent.lines) != 0 || latest(sent) != string(lineFor(device, sent.faction)) {
+			changed = true
+		}
+	}
+
+	if changed {
+		if wait := home.changedAt.Add(*debounce).Sub(now); wait > 0 {
+			home.sent.Unlock()
+			time.AfterFunc(wait, home.wakeup)
+			return
+		}
+	}
+
+	// The lines due to be queued for each device, and the functions that
+	// record them once they have been written
+	due := map[string][][]byte{}
+	recorders := map[string]func(err error){}
+	for key, device := range devices {
+		sent := home.sent.devices[key]
+		line := lineFor(device, sent.faction)
+		if len(sent.lines) == 0 && latest(sent) == string(line) && (len(sent.queued) != 0 || now.Sub(sent.at) < *keepalive) {
+			continue
+		}
+
+		// The line for the role of the device is followed by any
+		// lines generated by the rules
+		due[key] = append([][]byte{line}, sent.lines...)
+		recorders[key] = home.recorder(key, string(line), sent.faction, sent.lines)
+		sent.queued = string(line)
+		sent.lines = nil
+	}
+	home.sent.Unlock()
+
+	// The devices that were sent each of the lines
+	devicesSent := map[string][]string{}
+
+	for key, queued := range due {
+		// The device writes the lines in the background, records them
+		// once they have been written, and takes itself offline should
+		// it fail
+		device := devices[key]
+		device.queue(queued, recorders[key])
+		devicesSent[string(queued[0])] = append(devicesSent[string(queued[0])], device.devName)
+	}
+	for line, sent := range devicesSent {
+		logW.Info(fmt.Sprintf("%s %q ➡ %v", home.name, line, sent))
+	}
+
+	if changed {
+		home.changedAt = now
+	}
+}
+
+// recorder returns the function told whether the lines queued for a device
+// were written.  Once they have been the line for the device is recorded
+// along with the change of faction having been shown, otherwise the lines
+// from the rules are held to be sent again
+//
+func (home *homePortal) recorder(key string, line string, faction bool, extra [][]byte) func(err error) {
+	return func(err error) {
+		home.sent.Lock()
+		defer home.sent.Unlock()
+
+		device, ok := home.sent.devices[key]
+		if !ok {
 			return
 		}
+		if device.queued == line {
+			device.queued = ""
+		}
+		if err != nil {
+			device.lines = append(extra[:len(extra):len(extra)], device.lines...)
+			return
+		}
+		device.line = line
+		device.at = time.Now()
+
+		// The lowercase line follows once the change of faction has
+		// been shown
+		if faction && device.faction {
+			device.faction = false
+			home.wakeup()
+		}
+	}
+}
+
+// wakeup has the gateway send any changes to the arduinos without waiting
+// for the next refresh
+//
+func (home *homePortal) wakeup() {
+	select {
+	case home.wakeupC <- true:
+	default:
+	}
+}
+
+// deviceEvent processes an event raised by one of the arduinos of the portal
+// using the rules
+//
+func (home *homePortal) deviceEvent(ev *portalEvent) {
+
+	logW.Info(ev.String())
+
+	if home.mqtt != nil {
+		home.mqtt.publishEvent(ev)
+	}
+
+	// The conditions of the rules can refer to the status of the portal
+	state := lastState[home.name]
+	if state == nil {
+		state = &portalStatus{}
+	}
+
+	actions := home.rules.current().apply([]portalEvent{*ev}, state)
+
+	if len(actions.sfxs) != 0 {
+		go func() {
+			select {
+			case home.sfxC <- actions.sfxs:
+			case <-time.After(time.Second):
+			}
+		}()
+	}
+
+	if len(actions.lines) != 0 {
+		for _, device := range getRunningDevices(home.name) {
+			device.queue(actions.lines, nil)
+		}
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// drainDevice takes the lines queued for the device, telling those that
+// queued them the outcome given by err
+//
+func drainDevice(dev *arduino, err error) (lines []string) {
+	dev.outbox.Lock()
+	queued := dev.outbox.lines
+	dev.outbox.lines = nil
+	dev.outbox.Unlock()
+
+	lines = []string{}
+	for _, line := range queued {
+		line.report(err)
+		lines = append(lines, string(line.line))
+	}
+	return lines
+}
+
+func TestRefresh(t *testing.T) {
+
+	savedDebounce, savedKeepalive := *debounce, *keepalive
+	*debounce, *keepalive = 0, time.Hour
+	defer func() { *debounce, *keepalive = savedDebounce, savedKeepalive }()
+
+	dev := &arduino{portal: "Home", devName: "/dev/ttyACM0", key: "85531303", outbox: newWriteQueue(8)}
+
+	devices.Lock()
+	saved := devices.devices
+	devices.devices = map[string]map[string]*arduino{"Home": {dev.key: dev}}
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		devices.devices = saved
+		devices.Unlock()
+	}()
+
+	home := newHomePortal("Home")
+	home.wakeupC = make(chan bool, 1)
+
+	state := &portalStatus{Status: status{ControllingFaction: "Enlightened"}}
+	upper := string(encodeStatus(state, true))
+	lower := string(encodeStatus(state, false))
+
+	expect := func(step string, err error, lines ...string) {
+		if drained := drainDevice(dev, err); !reflect.DeepEqual(drained, append([]string{}, lines...)) {
+			t.Fatalf("%s: expected %q to be queued, not %q", step, lines, drained)
+		}
+	}
+
+	// A change of faction that is dropped, along with the line from the
+	// rules, is sent again
+	home.refresh(state, true, [][]byte{[]byte("x\n")})
+	expect("faction change", errDropped, upper, "x\n")
+
+	home.refresh(state, false, nil)
+	expect("faction change resent", nil, upper, "x\n")
+
+	// Once the change of faction has been written the lowercase line
+	// follows at once
+	select {
+	case <-home.wakeupC:
+	default:
+		t.Fatal("expected the gateway to be woken once the faction change was written")
+	}
+	home.refresh(state, false, nil)
+	expect("faction settled", nil, lower)
+
+	// Nothing is sent until the state changes, or the keepalive passes
+	home.refresh(state, false, nil)
+	expect("unchanged", nil)
+
+	// A line waiting to be written is not sent again
+	*keepalive = 0
+	home.refresh(state, false, nil)
+	home.refresh(state, false, nil)
+	expect("keepalive", nil, lower)
+}
@@ -0,0 +1,84 @@
+package main
+
+// This module implements the detection of arduinos being plugged in and
+// unplugged.  On Linux the gateway subscribes to the kernel uevents for ttys,
+// so that new arduinos are started as soon as they appear and arduinos that
+// are unplugged are removed immediately.  The devices are also rescanned
+// periodically, every -rescan period when uevents are not available, or once
+// a minute as a safety net when they are.  The -hotplug option can be used to
+// turn off the use of uevents.
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"time"
+)
+
+var (
+	hotplug      = flag.Bool("hotplug", true, "Use kernel uevents to detect arduinos being plugged in and removed, when false or not available the devices are rescanned periodically")
+	rescanPeriod = flag.Duration("rescan", 10*time.Second, "The period between scans for arduinos when uevents are not being used")
+)
+
+const (
+	// hotplugRescan is the period between scans for arduinos when uevents
+	// are being used, in case any are missed
+	hotplugRescan = time.Minute
+)
+
+// uevent is a kernel notification of a device being added or removed
+//
+type uevent struct {
+	action    string
+	subsystem string
+	devName   string
+}
+
+// parseUevent decodes a kernel uevent message, which consists of a header
+// followed by NUL separated KEY=value pairs
+//
+func parseUevent(msg []byte) (ev *uevent) {
+
+	ev = &uevent{}
+	for i, field := range bytes.Split(msg, []byte{0}) {
+		if i == 0 {
+			// The header, action@devpath
+			continue
+		}
+		parts := strings.SplitN(string(field), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "ACTION":
+			ev.action = parts[1]
+		case "SUBSYSTEM":
+			ev.subsystem = parts[1]
+		case "DEVNAME":
+			ev.devName = parts[1]
+		}
+	}
+	if len(ev.action) == 0 {
+		return nil
+	}
+	return ev
+}
+
+// devPath returns the path of the device node for the event
+//
+func (ev *uevent) devPath() (path string) {
+	if strings.HasPrefix(ev.devName, "/") {
+		return ev.devName
+	}
+	return "/dev/" + ev.devName
+}
+
+// isSerial tests whether the event is for a tty that could be an arduino
+//
+func (ev *uevent) isSerial() bool {
+	if ev.subsystem != "tty" {
+		return false
+	}
+	name := strings.TrimPrefix(ev.devName, "/dev/")
+	return strings.HasPrefix(name, "ttyACM") || strings.HasPrefix(name, "ttyUSB")
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package main
+
+// This module implements the subscription to the kernel uevents on Linux
+// using a netlink socket
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// watchUevents subscribes to the kernel uevents and sends the events for
+// ttys using the returned channel until the quitC channel is closed
+//
+func watchUevents(quitC chan bool) (eventC chan *uevent, err error) {
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("uevent socket could not be opened due to %s", err.Error())
+	}
+
+	// Group 1 carries the events from the kernel
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("uevent socket could not be bound due to %s", err.Error())
+	}
+
+	// Wake up regularly to check whether the gateway is stopping
+	timeout := syscall.NsecToTimeval(int64(time.Second))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("uevent socket could not be configured due to %s", err.Error())
+	}
+
+	eventC = make(chan *uevent, 16)
+
+	go func() {
+		defer syscall.Close(fd)
+
+		buf := make([]byte, 64*1024)
+		for {
+			select {
+			case <-quitC:
+				return
+			default:
+			}
+
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EAGAIN || err == syscall.EINTR {
+					continue
+				}
+				logW.Warn(fmt.Sprintf("uevents could not be read due to %s, falling back to rescanning", err.Error()))
+				close(eventC)
+				return
+			}
+
+			ev := parseUevent(buf[:n])
+			if ev == nil || !ev.isSerial() {
+				continue
+			}
+
+			select {
+			case eventC <- ev:
+			case <-quitC:
+				return
+			}
+		}
+	}()
+
+	return eventC, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// This module stands in for the kernel uevents on platforms other than Linux,
+// where the gateway rescans for arduinos periodically
+
+import (
+	"errors"
+)
+
+func watchUevents(quitC chan bool) (eventC chan *uevent, err error) {
+	return nil, errors.New("uevents are only available on Linux")
+}
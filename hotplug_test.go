@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// kernelUevent builds a uevent message as sent by the kernel
+//
+func kernelUevent(header string, fields ...string) []byte {
+	return []byte(header + "\x00" + strings.Join(fields, "\x00") + "\x00")
+}
+
+func TestParseUevent(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		msg    []byte
+		ev     *uevent
+		path   string
+		serial bool
+	}{
+		{
+			name: "arduino added",
+			msg: kernelUevent("add@/devices/pci0000:00/usb1/1-1/1-1:1.0/tty/ttyACM0",
+				"ACTION=add", "DEVPATH=/devices/pci0000:00/usb1/1-1/1-1:1.0/tty/ttyACM0", "SUBSYSTEM=tty", "DEVNAME=ttyACM0", "SEQNUM=1234"),
+			ev:     &uevent{action: "add", subsystem: "tty", devName: "ttyACM0"},
+			path:   "/dev/ttyACM0",
+			serial: true,
+		},
+		{
+			name:   "adapter removed",
+			msg:    kernelUevent("remove@/devices/usb1/1-2/tty/ttyUSB1", "ACTION=remove", "SUBSYSTEM=tty", "DEVNAME=/dev/ttyUSB1"),
+			ev:     &uevent{action: "remove", subsystem: "tty", devName: "/dev/ttyUSB1"},
+			path:   "/dev/ttyUSB1",
+			serial: true,
+		},
+		{
+			name: "console",
+			msg:  kernelUevent("add@/devices/virtual/tty/tty1", "ACTION=add", "SUBSYSTEM=tty", "DEVNAME=tty1"),
+			ev:   &uevent{action: "add", subsystem: "tty", devName: "tty1"},
+			path: "/dev/tty1",
+		},
+		{
+			name: "usb interface",
+			msg:  kernelUevent("add@/devices/usb1/1-1/1-1:1.0", "ACTION=add", "SUBSYSTEM=usb", "DEVNAME=bus/usb/001/002"),
+			ev:   &uevent{action: "add", subsystem: "usb", devName: "bus/usb/001/002"},
+			path: "/dev/bus/usb/001/002",
+		},
+		{
+			// Only the header, which is not trusted for the action
+			name: "header",
+			msg:  []byte("add@/devices/usb1/1-1/tty/ttyACM0"),
+		},
+		{
+			name: "garbage",
+			msg:  []byte("\x00\x00ACTION\x00=add"),
+		},
+	}
+
+	for _, test := range tests {
+		ev := parseUevent(test.msg)
+		if test.ev == nil {
+			if ev != nil {
+				t.Errorf("%s: expected no event, not %+v", test.name, *ev)
+			}
+			continue
+		}
+		if ev == nil {
+			t.Errorf("%s: expected an event", test.name)
+			continue
+		}
+		if *ev != *test.ev {
+			t.Errorf("%s: expected %+v, not %+v", test.name, *test.ev, *ev)
+		}
+		if path := ev.devPath(); path != test.path {
+			t.Errorf("%s: expected the device %s, not %s", test.name, test.path, path)
+		}
+		if serial := ev.isSerial(); serial != test.serial {
+			t.Errorf("%s: expected the device to be serial %t, not %t", test.name, test.serial, serial)
+		}
+	}
+}
+
+func TestAwaitRescan(t *testing.T) {
+
+	master, name := openPty(t)
+	defer master.Close()
+	port, err := serial.OpenPort(&serial.Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := &arduino{port: port, devName: name, portal: "hotplug", key: "85531303"}
+	devices.Lock()
+	if devices.devices == nil {
+		devices.devices = map[string]map[string]*arduino{}
+	}
+	devices.devices[dev.portal] = map[string]*arduino{dev.key: dev}
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		delete(devices.devices, dev.portal)
+		devices.Unlock()
+	}()
+
+	portals := []string{dev.portal}
+	wait := 300 * time.Millisecond
+	quitC := make(chan bool)
+
+	tests := []struct {
+		name   string
+		events []*uevent
+		early  bool
+	}{
+		// Changes to a device do not bring the scan forward
+		{"change", []*uevent{{action: "change", subsystem: "tty", devName: "ttyACM9"}, {action: "bind", subsystem: "tty", devName: "ttyACM9"}}, false},
+		{"add", []*uevent{{action: "change", subsystem: "tty", devName: "ttyACM9"}, {action: "add", subsystem: "tty", devName: name}}, true},
+		{"remove", []*uevent{{action: "remove", subsystem: "tty", devName: name}}, true},
+	}
+
+	for _, test := range tests {
+		ueventC := make(chan *uevent, len(test.events))
+		for _, ev := range test.events {
+			ueventC <- ev
+		}
+
+		started := time.Now()
+		closed, quit := awaitRescan(portals, wait, ueventC, quitC)
+		if closed || quit {
+			t.Errorf("%s: expected to scan, not to be closed %t or quit %t", test.name, closed, quit)
+		}
+		if early := time.Since(started) < wait/2; early != test.early {
+			t.Errorf("%s: expected the scan to be early %t, not %t", test.name, test.early, early)
+		}
+	}
+
+	// The unplugged device has been stopped
+	if _, running := getRunningDevices(dev.portal)[dev.key]; running {
+		t.Error("expected the unplugged device to be stopped")
+	}
+	if _, err = port.Write([]byte("x")); err == nil {
+		t.Error("expected the unplugged device to be closed")
+	}
+
+	ueventC := make(chan *uevent)
+	close(ueventC)
+	if closed, quit := awaitRescan(portals, wait, ueventC, quitC); !closed || quit {
+		t.Errorf("expected the uevents to be closed, not %t and quit %t", closed, quit)
+	}
+
+	close(quitC)
+	if closed, quit := awaitRescan(portals, wait, nil, quitC); closed || !quit {
+		t.Errorf("expected to quit, not %t and closed %t", quit, closed)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+// This module implements the HTTP client used to poll tecthulhus and
+// concentrators.  Requests are bounded by connect and read deadlines so
+// that a hung server cannot stall the gateway, conditional requests are
+// used to avoid transferring documents that have not changed, and servers
+// that are failing are polled less frequently using an exponential backoff
+// until they recover.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	pollInterval   = flag.Duration("poll", 2*time.Second, "The interval between polls of healthy tecthulhu and concentrator servers")
+	connectTimeout = flag.Duration("connectTimeout", 2*time.Second, "The maximum time allowed to connect to a tecthulhu or concentrator server")
+	readTimeout    = flag.Duration("readTimeout", 5*time.Second, "The maximum time allowed for a tecthulhu or concentrator server to respond once connected")
+	maxBackoff     = flag.Duration("maxBackoff", time.Minute, "The maximum interval between polls of a failing tecthulhu or concentrator server")
+)
+
+type httpPoller struct {
+	client *http.Client
+
+	// Validators and the document returned by the last successful request
+	etag         string
+	lastModified string
+	body         []byte
+
+	// The number of consecutive failed requests
+	failures uint
+}
+
+func newHTTPPoller() (poller *httpPoller) {
+	return &httpPoller{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial:                  (&net.Dialer{Timeout: *connectTimeout}).Dial,
+				ResponseHeaderTimeout: *readTimeout,
+			},
+			Timeout: *connectTimeout + *readTimeout,
+		},
+	}
+}
+
+// poll retrieves and decodes the status at the uri.  Documents that cannot be
+// decoded count as failures in the same way as requests that fail, so that a
+// server returning garbage is backed off
+//
+func (poller *httpPoller) poll(uri string, decode func(body []byte) (*portalStatus, error)) (status *portalStatus, err error) {
+
+	defer func() {
+		if err != nil {
+			poller.failures++
+		} else {
+			poller.failures = 0
+		}
+	}()
+
+	body, err := poller.fetch(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if status, err = decode(body); err != nil {
+		// Forget the document so that it is not reused should the
+		// server report it as unchanged
+		poller.etag = ""
+		poller.lastModified = ""
+		poller.body = nil
+		return nil, err
+	}
+	return status, nil
+}
+
+// fetch retrieves the document at the uri, when the server indicates the
+// document is unchanged the previously retrieved document is returned
+//
+func (poller *httpPoller) fetch(uri string) (body []byte, err error) {
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(poller.body) != 0 {
+		if len(poller.etag) != 0 {
+			req.Header.Set("If-None-Match", poller.etag)
+		}
+		if len(poller.lastModified) != 0 {
+			req.Header.Set("If-Modified-Since", poller.lastModified)
+		}
+	}
+
+	resp, err := poller.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return poller.body, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, err
+	}
+
+	poller.etag = resp.Header.Get("ETag")
+	poller.lastModified = resp.Header.Get("Last-Modified")
+	poller.body = body
+
+	return body, nil
+}
+
+// delay returns the time to wait before the next poll, servers that are
+// failing are polled using an exponential backoff with jitter added to
+// prevent failing servers from being polled in lock step
+//
+func (poller *httpPoller) delay() (delay time.Duration) {
+	if poller.failures == 0 {
+		return *pollInterval
+	}
+
+	delay = *pollInterval
+	for i := uint(0); i < poller.failures && delay < *maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > *maxBackoff {
+		delay = *maxBackoff
+	}
+
+	// Choose a delay in the upper half of the backoff
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
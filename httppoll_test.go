@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPPollNotModified(t *testing.T) {
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, streamDoc("A"))
+	}))
+	defer server.Close()
+
+	poller := newHTTPPoller()
+	for i := 0; i < 3; i++ {
+		status, err := poller.poll(server.URL, decodeTecthulhu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status.Title != "A" {
+			t.Fatalf("expected the portal A, not '%s'", status.Status.Title)
+		}
+	}
+	if requests != 3 || poller.failures != 0 {
+		t.Fatalf("expected 3 requests without failures, not %d requests and %d failures", requests, poller.failures)
+	}
+	if delay := poller.delay(); delay != *pollInterval {
+		t.Fatalf("expected a healthy server to be polled every %s, not %s", pollInterval.String(), delay.String())
+	}
+}
+
+func TestHTTPPollUndecodable(t *testing.T) {
+
+	garbage := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if garbage {
+			w.Header().Set("ETag", `"garbage"`)
+			fmt.Fprint(w, "<html>not a portal</html>")
+			return
+		}
+		// The server would confirm the garbage is unchanged if asked
+		if r.Header.Get("If-None-Match") == `"garbage"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, streamDoc("A"))
+	}))
+	defer server.Close()
+
+	poller := newHTTPPoller()
+	for i := 1; i <= 3; i++ {
+		if _, err := poller.poll(server.URL, decodeTecthulhu); err == nil {
+			t.Fatal("expected the garbage to be rejected")
+		}
+		if poller.failures != uint(i) {
+			t.Fatalf("expected %d failures, not %d", i, poller.failures)
+		}
+	}
+	if delay := poller.delay(); delay <= *pollInterval {
+		t.Fatalf("expected a server returning garbage to be backed off, not polled after %s", delay.String())
+	}
+
+	// The garbage is not used as the basis for a conditional request
+	garbage = false
+	status, err := poller.poll(server.URL, decodeTecthulhu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status.Title != "A" || poller.failures != 0 {
+		t.Fatalf("expected the portal A without failures, not '%s' and %d failures", status.Status.Title, poller.failures)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+// This module implements a journal of the portal statuses received by the
+// gateway.  When the -record option is used every status received from any
+// source is appended to the journal file as a line of JSon along with the
+// time it was received and its source.
+//
+// Journals can be played back using a replay:// URI as one of the tecthulhus,
+// for example replay://captures/weekend.jsonl?speed=10, reproducing the original
+// timing between statuses so that real world data can be used to debug the
+// gateway and arduinos on a bench.  Absolute paths use three slashes,
+// replay:///home/pi/weekend.jsonl.  The loop parameter restarts the journal once
+// it has been played, the speed parameter is a multiplier for the playback rate,
+// and the source parameter limits playback to the statuses recorded from a
+// single source.
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	recordFile = flag.String("record", "", "A file to which every portal status received is appended, as line delimited JSon, for later replay")
+)
+
+type journalEntry struct {
+	Received time.Time     `json:"received"`
+	Source   string        `json:"source"`
+	Status   *portalStatus `json:"status"`
+}
+
+// startRecorder appends the statuses arriving on inC to the journal and then
+// passes them on using outC
+//
+func startRecorder(journal string, inC chan *portalStatus, outC chan *portalStatus, errorC chan error, quitC chan bool) (err error) {
+
+	file, err := os.OpenFile(journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer file.Close()
+
+		encoder := json.NewEncoder(file)
+
+		for {
+			select {
+			case state := <-inC:
+				entry := &journalEntry{
+					Received: time.Now(),
+					Source:   state.Source,
+					Status:   state,
+				}
+				if err := encoder.Encode(entry); err != nil {
+					publishError(fmt.Errorf("portal status from %s could not be recorded to %s due to %s", state.Source, journal, err.Error()), errorC)
+				}
+
+				select {
+				case outC <- state:
+				case <-quitC:
+					return
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+type replay struct {
+	url     string
+	statusC chan *portalStatus
+	errorC  chan error
+}
+
+// startPortals plays back the journal reproducing the original timing
+//
+func (play *replay) startPortals(quitC chan bool) (err error) {
+
+	playURL, err := url.Parse(play.url)
+	if err != nil {
+		publishError(fmt.Errorf("replay %s could not be used due to %s", play.url, err.Error()), play.errorC)
+		return err
+	}
+
+	query := playURL.Query()
+	loop := query.Get("loop") == "true"
+	source := query.Get("source")
+	speed := 1.0
+	if speedStr := query.Get("speed"); len(speedStr) != 0 {
+		if speed, err = strconv.ParseFloat(speedStr, 64); err != nil || speed <= 0 {
+			err = fmt.Errorf("replay %s has an invalid speed '%s'", play.url, speedStr)
+			publishError(err, play.errorC)
+			return err
+		}
+	}
+
+	journal := filepath.FromSlash(playURL.Host + playURL.Path)
+
+	for {
+		quit, err := play.playJournal(journal, source, speed, quitC)
+		if err != nil {
+			publishError(fmt.Errorf("replay %s failed due to %s", play.url, err.Error()), play.errorC)
+			return err
+		}
+		if quit || !loop {
+			if !quit {
+				logW.Info(fmt.Sprintf("replay %s finished", play.url))
+			}
+			return nil
+		}
+		logW.Debug(fmt.Sprintf("restarting replay %s", play.url))
+	}
+}
+
+// playJournal plays the journal once, the returned flag indicates the gateway
+// is stopping
+//
+func (play *replay) playJournal(journal string, source string, speed float64, quitC chan bool) (quit bool, err error) {
+
+	file, err := os.Open(journal)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	first := time.Time{}
+	start := time.Now()
+
+	for line := 1; scanner.Scan(); line++ {
+		entry := &journalEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Status == nil {
+			logW.Warn(fmt.Sprintf("skipping line %d of %s as it is not a journal entry", line, journal))
+			continue
+		}
+		if len(source) != 0 && entry.Source != source {
+			continue
+		}
+
+		if first.IsZero() {
+			first = entry.Received
+		}
+
+		// Wait until the same time has passed since the start of the replay
+		// as had passed when the status was originally received
+		due := start.Add(time.Duration(float64(entry.Received.Sub(first)) / speed))
+		select {
+		case <-time.After(due.Sub(time.Now())):
+		case <-quitC:
+			return true, nil
+		}
+
+		logW.Trace(fmt.Sprintf("replaying status for '%s' recorded from %s at %s", entry.Status.Status.Title, entry.Source, entry.Received.String()))
+		publishStatus(play.url, entry.Status, play.statusC, play.errorC)
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeJournal writes the statuses to a journal, each received the given time
+// after the first
+//
+func writeJournal(t *testing.T, file string, offsets []time.Duration, titles []string, sources []string) {
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	encoder := json.NewEncoder(out)
+	first := time.Now().Add(-time.Hour)
+	for i, offset := range offsets {
+		entry := &journalEntry{
+			Received: first.Add(offset),
+			Source:   sources[i],
+			Status:   &portalStatus{Status: status{Title: titles[i]}, Source: sources[i]},
+		}
+		if err = encoder.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournalRecord(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "journal.jsonl")
+
+	inC := make(chan *portalStatus)
+	outC := make(chan *portalStatus)
+	errorC := make(chan error, 10)
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	if err = startRecorder(file, inC, outC, errorC, quitC); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each status is passed on once it has been recorded
+	for _, state := range []*portalStatus{
+		{Status: status{Title: "A"}, Source: "tecthulhu://a"},
+		{Status: status{Title: "B"}, Source: "tecthulhu://b"},
+	} {
+		inC <- state
+		if passed := <-outC; passed != state {
+			t.Fatalf("expected the status for %s to be passed on", state.Status.Title)
+		}
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	entries := []*journalEntry{}
+	for scanner := bufio.NewScanner(in); scanner.Scan(); {
+		entry := &journalEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 || entries[0].Status.Status.Title != "A" || entries[1].Status.Status.Title != "B" {
+		t.Fatalf("expected the statuses A and B to be recorded, not %d statuses", len(entries))
+	}
+	if entries[0].Source != "tecthulhu://a" || entries[1].Source != "tecthulhu://b" || entries[1].Received.Before(entries[0].Received) {
+		t.Fatalf("expected the sources and times to be recorded, not %+v and %+v", *entries[0], *entries[1])
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "journal.jsonl")
+
+	writeJournal(t, file,
+		[]time.Duration{0, 400 * time.Millisecond, 800 * time.Millisecond, 1200 * time.Millisecond},
+		[]string{"A", "B", "other", "C"},
+		[]string{"x", "x", "y", "x"})
+
+	// The statuses are replayed in order, with the time between them
+	// divided by the speed
+	tests := []struct {
+		query  string
+		titles []string
+		gaps   []time.Duration
+	}{
+		{"?speed=2&source=x", []string{"A", "B", "C"}, []time.Duration{200 * time.Millisecond, 400 * time.Millisecond}},
+		{"?speed=4", []string{"A", "B", "other", "C"}, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}},
+	}
+
+	for _, test := range tests {
+		uri := "replay://" + filepath.ToSlash(file) + test.query
+		statusC, _, stop := streamSource(t, uri)
+
+		last := time.Time{}
+		for i, title := range test.titles {
+			select {
+			case state := <-statusC:
+				if state.Status.Title != title || state.Source != uri {
+					t.Errorf("%s: expected the status %s from the replay, not %s from %s", test.query, title, state.Status.Title, state.Source)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out waiting for the status %s", test.query, title)
+			}
+			now := time.Now()
+			if i != 0 {
+				gap := now.Sub(last)
+				if expected := test.gaps[i-1]; gap < expected-20*time.Millisecond || gap > expected+150*time.Millisecond {
+					t.Errorf("%s: expected %s between %s and %s, not %s", test.query, expected, test.titles[i-1], title, gap)
+				}
+			}
+			last = now
+		}
+		stop()
+	}
+}
+
+func TestJournalTruncated(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "journal.jsonl")
+
+	writeJournal(t, file,
+		[]time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond},
+		[]string{"A", "B", "C"},
+		[]string{"x", "x", "x"})
+
+	// Cut the journal off part way through the last status, as happens
+	// when the gateway is stopped while recording, and damage a line
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte("{\"received\": \n"), data[:len(data)-20]...)
+	if err = ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	statusC, errorC, stop := streamSource(t, "replay://"+filepath.ToSlash(file))
+	defer stop()
+
+	for _, title := range []string{"A", "B"} {
+		select {
+		case state := <-statusC:
+			if state.Status.Title != title {
+				t.Fatalf("expected the status %s, not %s", title, state.Status.Title)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the status %s", title)
+		}
+	}
+
+	// The damaged lines are skipped rather than ending the replay in error
+	select {
+	case state := <-statusC:
+		t.Fatalf("expected the truncated status to be skipped, not %s", state.Status.Title)
+	case err = <-errorC:
+		t.Fatalf("expected the replay to finish, not %s", err.Error())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+// This module implements the tracking of the activity of each agent on the
+// home portals, using the owners of the resonators and of the portal.  For
+// each agent the resonators deployed, upgraded, replaced and lost are counted,
+// along with the time the agent has owned the portal.  A resonator is replaced
+// when it is destroyed and a resonator of another agent is deployed in the same
+// position within a single status.
+//
+// The leaderboard for each portal, grouped by faction, can be written to a
+// JSon file using the -leaderboard option and served using the -api option,
+// for example -api=127.0.0.1:8090, at /leaderboard.  A single portal can be
+// requested using /leaderboard?portal=Camp%20Navarro.  The file is read back
+// when the gateway starts so that the counts survive restarts.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	leaderboardFile = flag.String("leaderboard", "", "A JSon file to which the leaderboard of agents for each home portal is written")
+	apiAddress      = flag.String("api", "", "The address, for example 127.0.0.1:8090, on which the leaderboard and the state of the arduinos are served")
+)
+
+type agentActivity struct {
+	Agent        string  `json:"agent"`
+	Faction      string  `json:"faction"`
+	Score        int     `json:"score"`
+	Deployed     int     `json:"deployed"`
+	Upgraded     int     `json:"upgraded"`
+	Replaced     int     `json:"replaced"`
+	Lost         int     `json:"lost"`
+	OwnedSeconds float64 `json:"ownedSeconds"`
+}
+
+// agents sorts the agents with the highest score first
+type agents []*agentActivity
+
+func (a agents) Len() int      { return len(a) }
+func (a agents) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a agents) Less(i, j int) bool {
+	if a[i].Score != a[j].Score {
+		return a[i].Score > a[j].Score
+	}
+	return a[i].Agent < a[j].Agent
+}
+
+// leaderboard holds the activity of the agents on each of the home portals
+//
+type leaderboard struct {
+	file string
+
+	// Activity indexed by portal and then agent
+	portals map[string]map[string]*agentActivity
+
+	// When each portal was last observed, and who owned it
+	observed map[string]time.Time
+	owners   map[string]agentActivity
+
+	dirty   bool
+	written time.Time
+	sync.Mutex
+}
+
+func newLeaderboard(file string, portals []string) (board *leaderboard) {
+
+	board = &leaderboard{
+		file:     file,
+		portals:  map[string]map[string]*agentActivity{},
+		observed: map[string]time.Time{},
+		owners:   map[string]agentActivity{},
+	}
+	for _, portal := range portals {
+		board.portals[portal] = map[string]*agentActivity{}
+	}
+
+	if len(file) == 0 {
+		return board
+	}
+
+	// Carry on from the counts written before the gateway was restarted
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logW.Warn(fmt.Sprintf("leaderboard %s could not be read due to %s", file, err.Error()))
+		}
+		return board
+	}
+	saved := map[string]map[string][]*agentActivity{}
+	if err = json.Unmarshal(data, &saved); err != nil {
+		logW.Warn(fmt.Sprintf("leaderboard %s could not be decoded due to %s", file, err.Error()))
+		return board
+	}
+	for portal, factions := range saved {
+		if _, ok := board.portals[portal]; !ok {
+			continue
+		}
+		for _, list := range factions {
+			for _, activity := range list {
+				board.portals[portal][activity.Agent] = activity
+			}
+		}
+	}
+	return board
+}
+
+// agent returns the activity for an agent, adding the agent when needed
+//
+func (board *leaderboard) agent(portal string, name string, faction string) (activity *agentActivity) {
+	activity, ok := board.portals[portal][name]
+	if !ok {
+		activity = &agentActivity{Agent: name}
+		board.portals[portal][name] = activity
+	}
+	if len(faction) != 0 && faction != "Neutral" {
+		activity.Faction = faction
+	}
+	return activity
+}
+
+// record updates the activity of the agents using the events derived from a
+// status of the portal
+//
+func (board *leaderboard) record(events []portalEvent, state *portalStatus) {
+
+	portal := state.Status.Title
+
+	board.Lock()
+	defer board.Unlock()
+
+	if _, ok := board.portals[portal]; !ok {
+		return
+	}
+
+	// Resonators destroyed in this status, by position, so that the
+	// resonators deployed in their place can be recognized
+	destroyed := map[string]string{}
+	for _, ev := range events {
+		if ev.Kind == resonatorDestroyed && len(ev.Owner) != 0 {
+			destroyed[ev.Position] = ev.Owner
+		}
+	}
+
+	for _, ev := range events {
+		if len(ev.Owner) == 0 {
+			continue
+		}
+		switch ev.Kind {
+		case resonatorDeployed:
+			// Resonators left on a portal gone neutral were lost rather
+			// than deployed by anyone
+			if ev.Faction == "Neutral" {
+				continue
+			}
+			activity := board.agent(portal, ev.Owner, ev.Faction)
+			activity.Deployed++
+			if prev, ok := destroyed[ev.Position]; ok && prev != ev.Owner {
+				activity.Replaced++
+			}
+		case resonatorUpgraded:
+			board.agent(portal, ev.Owner, ev.Faction).Upgraded++
+		case resonatorDestroyed:
+			board.agent(portal, ev.Owner, ev.Faction).Lost++
+		default:
+			continue
+		}
+		board.dirty = true
+	}
+
+	// The time since the last status is credited to the agent that owned
+	// the portal at the time
+	now := time.Now()
+	if owner, ok := board.owners[portal]; ok && len(owner.Agent) != 0 && owner.Faction != "Neutral" {
+		board.agent(portal, owner.Agent, owner.Faction).OwnedSeconds += now.Sub(board.observed[portal]).Seconds()
+	}
+	board.observed[portal] = now
+	board.owners[portal] = agentActivity{Agent: state.Status.Owner, Faction: state.Status.ControllingFaction}
+
+	for _, activity := range board.portals[portal] {
+		activity.Score = activity.Deployed + activity.Upgraded + activity.Replaced
+	}
+
+	// Counts are written as they change, the time owned is only written
+	// once a minute
+	if len(board.file) != 0 && (board.dirty || now.Sub(board.written) > time.Minute) {
+		if err := board.write(); err != nil {
+			logW.Warn(fmt.Sprintf("leaderboard %s could not be written due to %s", board.file, err.Error()))
+		}
+		board.dirty = false
+		board.written = now
+	}
+}
+
+// standings returns the agents of the portal grouped by faction, the caller
+// must hold the lock
+//
+func (board *leaderboard) standings(portal string) (factions map[string][]*agentActivity) {
+	factions = map[string][]*agentActivity{}
+	for _, activity := range board.portals[portal] {
+		faction := activity.Faction
+		if len(faction) == 0 {
+			faction = "Neutral"
+		}
+		copied := *activity
+		factions[faction] = append(factions[faction], &copied)
+	}
+	for _, list := range factions {
+		sort.Sort(agents(list))
+	}
+	return factions
+}
+
+// marshal encodes the leaderboard of a single portal, or of every portal when
+// the portal is not given
+//
+func (board *leaderboard) marshal(portal string) (data []byte, err error) {
+
+	board.Lock()
+	defer board.Unlock()
+
+	if len(portal) != 0 {
+		if _, ok := board.portals[portal]; !ok {
+			return nil, fmt.Errorf("unknown portal '%s'", portal)
+		}
+		return json.MarshalIndent(board.standings(portal), "", "    ")
+	}
+
+	return json.MarshalIndent(board.everyPortal(), "", "    ")
+}
+
+// everyPortal returns the standings of all of the portals, the caller must
+// hold the lock
+//
+func (board *leaderboard) everyPortal() (all map[string]map[string][]*agentActivity) {
+	all = map[string]map[string][]*agentActivity{}
+	for name := range board.portals {
+		all[name] = board.standings(name)
+	}
+	return all
+}
+
+// write replaces the leaderboard file, the caller must hold the lock
+//
+func (board *leaderboard) write() (err error) {
+
+	data, err := json.MarshalIndent(board.everyPortal(), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see a
+	// partially written leaderboard
+	tmp, err := ioutil.TempFile(filepath.Dir(board.file), ".leaderboard")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), board.file)
+}
+
+// startAPI serves the leaderboard over HTTP
+//
+func startAPI(address string, board *leaderboard, errorC chan error) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		data, err := board.marshal(r.URL.Query().Get("portal"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+	})
+	mux.HandleFunc("/devices", serveDevices)
+	mux.HandleFunc("/devices/clear", serveClear)
+
+	logW.Info(fmt.Sprintf("serving the leaderboard on http://%s/leaderboard", address))
+
+	if err := http.ListenAndServe(address, mux); err != nil {
+		publishError(fmt.Errorf("the API on %s failed due to %s", address, err.Error()), errorC)
+	}
+}
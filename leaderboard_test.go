@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordStatus records the change from the previous status of the portal, if
+// any, to the current one
+//
+func recordStatus(board *leaderboard, prev *portalStatus, cur *portalStatus) {
+	board.record(diffPortal(prev, cur, nil), cur)
+}
+
+// checkActivity compares the counts of an agent, ignoring the time owned
+//
+func checkActivity(t *testing.T, board *leaderboard, step string, expected agentActivity) {
+	activity, ok := board.portals["P"][expected.Agent]
+	if !ok {
+		t.Errorf("%s: expected the agent %s on the leaderboard", step, expected.Agent)
+		return
+	}
+	got := *activity
+	got.OwnedSeconds = 0
+	if got != expected {
+		t.Errorf("%s: expected %+v, not %+v", step, expected, got)
+	}
+}
+
+func TestLeaderboardRecord(t *testing.T) {
+
+	board := newLeaderboard("", []string{"P"})
+
+	prev := &portalStatus{Status: status{
+		Title:              "P",
+		ControllingFaction: "Enlightened",
+		Owner:              "alice",
+		Resonators:         []resonator{{Position: "N", Level: 3, Health: 100, Owner: "alice"}},
+	}}
+	recordStatus(board, nil, prev)
+	if len(board.portals["P"]) != 0 {
+		t.Fatalf("expected the first status to count for no one, not %d agents", len(board.portals["P"]))
+	}
+
+	steps := []struct {
+		name     string
+		change   func(after *status)
+		expected []agentActivity
+	}{
+		{
+			name: "deploy",
+			change: func(after *status) {
+				after.Resonators = append(after.Resonators, resonator{Position: "E", Level: 4, Health: 100, Owner: "bob"})
+			},
+			expected: []agentActivity{{Agent: "bob", Faction: "Enlightened", Score: 1, Deployed: 1}},
+		},
+		{
+			name: "upgrade",
+			change: func(after *status) {
+				after.Resonators[0].Level = 5
+			},
+			expected: []agentActivity{{Agent: "alice", Faction: "Enlightened", Score: 1, Upgraded: 1}},
+		},
+		{
+			name: "replace",
+			change: func(after *status) {
+				after.Resonators[1].Owner = "carol"
+			},
+			expected: []agentActivity{
+				{Agent: "bob", Faction: "Enlightened", Score: 1, Deployed: 1, Lost: 1},
+				{Agent: "carol", Faction: "Enlightened", Score: 2, Deployed: 1, Replaced: 1},
+			},
+		},
+		{
+			name: "loss",
+			change: func(after *status) {
+				after.Resonators = after.Resonators[1:]
+			},
+			expected: []agentActivity{{Agent: "alice", Faction: "Enlightened", Score: 1, Upgraded: 1, Lost: 1}},
+		},
+	}
+
+	for _, step := range steps {
+		cur := prev.copy()
+		step.change(&cur.Status)
+		recordStatus(board, prev, cur)
+		for _, expected := range step.expected {
+			checkActivity(t, board, step.name, expected)
+		}
+		prev = cur
+	}
+}
+
+func TestLeaderboardOwned(t *testing.T) {
+
+	board := newLeaderboard("", []string{"P"})
+
+	// owned records a status after the portal has been held for a time
+	owned := func(held time.Duration, faction string, owner string) {
+		board.observed["P"] = time.Now().Add(-held)
+		board.record([]portalEvent{}, &portalStatus{Status: status{Title: "P", ControllingFaction: faction, Owner: owner}})
+	}
+	seconds := func(agent string) float64 {
+		if activity, ok := board.portals["P"][agent]; ok {
+			return activity.OwnedSeconds
+		}
+		return 0
+	}
+
+	owned(0, "Enlightened", "alice")
+	// The time up until the faction change is credited to the previous owner
+	owned(10*time.Second, "Resistance", "dave")
+	owned(5*time.Second, "Neutral", "")
+	// No one is credited for the time the portal was neutral
+	owned(20*time.Second, "Neutral", "")
+
+	if alice := seconds("alice"); alice < 10 || alice > 11 {
+		t.Errorf("expected alice to have owned the portal for 10 seconds, not %.1f", alice)
+	}
+	if dave := seconds("dave"); dave < 5 || dave > 6 {
+		t.Errorf("expected dave to have owned the portal for 5 seconds, not %.1f", dave)
+	}
+	if board.portals["P"]["alice"].Faction != "Enlightened" || board.portals["P"]["dave"].Faction != "Resistance" {
+		t.Errorf("expected the owners to keep their factions, not %+v", board.standings("P"))
+	}
+	if len(board.portals["P"]) != 2 {
+		t.Errorf("expected only alice and dave on the leaderboard, not %+v", board.standings("P"))
+	}
+}
+
+// TestLeaderboardDrained plays the XM_drain_all scenario, in which the portal
+// goes neutral with its resonators still listed, and checks each agent loses
+// their resonators once and no one deploys for the neutral faction
+//
+func TestLeaderboardDrained(t *testing.T) {
+
+	steps, _, err := loadScenario(filepath.Join("simulator", "scenarios", "XM_drain_all"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	board := newLeaderboard("", []string{"Camp Navarro"})
+	var prev *portalStatus
+	for _, step := range steps {
+		board.record(diffPortal(prev, step.status, nil), step.status)
+		prev = step.status
+	}
+
+	lost := map[string]int{"goliadtx": 2, "Matti91Tilde": 4, "ace": 1, "Wrenegade": 1}
+	for agent, activity := range board.portals["Camp Navarro"] {
+		if activity.Lost != lost[agent] {
+			t.Errorf("expected %s to have lost %d resonators, not %d", agent, lost[agent], activity.Lost)
+		}
+		if activity.Deployed != 0 || activity.Faction == "Neutral" {
+			t.Errorf("expected %s to have deployed nothing for the neutral faction, not %+v", agent, *activity)
+		}
+	}
+	for agent := range lost {
+		if _, ok := board.portals["Camp Navarro"][agent]; !ok {
+			t.Errorf("expected %s on the leaderboard", agent)
+		}
+	}
+}
+
+func TestLeaderboardSaved(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "leaderboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "leaderboard.json")
+
+	board := newLeaderboard(file, []string{"P", "Q"})
+
+	prev := &portalStatus{Status: status{Title: "P", ControllingFaction: "Resistance", Owner: "alice"}}
+	cur := prev.copy()
+	cur.Status.Resonators = []resonator{
+		{Position: "N", Level: 6, Health: 100, Owner: "alice"},
+		{Position: "S", Level: 7, Health: 100, Owner: "bob"},
+	}
+	recordStatus(board, nil, prev)
+	board.observed["P"] = time.Now().Add(-30 * time.Second)
+	recordStatus(board, prev, cur)
+
+	// The counts are read back for the portals still being watched
+	restored := newLeaderboard(file, []string{"P"})
+	if !reflect.DeepEqual(restored.portals["P"], board.portals["P"]) {
+		t.Errorf("expected the leaderboard %+v to be restored, not %+v", board.standings("P"), restored.standings("P"))
+	}
+	if _, ok := restored.portals["Q"]; ok {
+		t.Errorf("expected the portal Q to be dropped once no longer watched")
+	}
+	if alice := restored.portals["P"]["alice"]; alice == nil || alice.OwnedSeconds < 30 {
+		t.Errorf("expected the time alice owned the portal to be restored, not %+v", alice)
+	}
+
+	// A damaged file leaves an empty leaderboard rather than failing
+	if err = ioutil.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if damaged := newLeaderboard(file, []string{"P"}); len(damaged.portals["P"]) != 0 {
+		t.Errorf("expected a damaged leaderboard to be ignored, not %+v", damaged.standings("P"))
+	}
+}
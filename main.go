@@ -12,16 +12,149 @@ import (
 )
 
 var (
-	arduinos      = flag.String("arduinos", "", "A list of the preferred arduino devices to be used")
-	tecthulhus    = flag.String("tecthulhus", "http://127.0.0.1:12345", "A list of either a serial devices usb://dev/ttyAMA10, or http://IP:port numbers/ for the tecthulhu REST/JSon servers to watch")
+	arduinos      = flag.String("arduinos", "", "A list of the preferred arduino devices to be used, each optionally prefixed with the portal it drives, for example 'Team NorCal=/dev/ttyACM0'")
+	tecthulhus    = flag.String("tecthulhus", "http://127.0.0.1:12345", "A list of either a serial devices serial:///dev/ttyUSB0?baud=115200, http://IP:port numbers/ for the tecthulhu REST/JSon servers to watch, ws://IP:port/ and sse+http://IP:port/ for servers that push updates, scenario://simulator/scenarios/name for simulator scenarios, replay://file.jsonl for recorded journals, or mqtt://broker:1883/topic for MQTT")
 	concAddress   = flag.String("concentrator", "", "The TCP/IP address of a Niantic concetrator if available")
-	homeTecthulhu = flag.String("home", "Team NorCal", "The name of the portal which we wish to subscribe to and use to drive our arduinos")
+	homeTecthulhu = flag.String("home", "Team NorCal", "A list of the names of the portals which we wish to subscribe to and use to drive our arduinos")
 	logLevel      = flag.String("loglevel", "warning", "Set the desired log level")
 )
 
 // create Logger interface
 var logW = log.NewLogger(log.NewConcurrentWriter(os.Stdout), "pi-gateway")
 
+// parsePortalList splits a comma seperated list of values, such as device
+// names, into those that are explicitly assigned to a portal using a
+// 'portal=value' prefix and those that are not
+//
+func parsePortalList(list string, portals []string) (assigned map[string][]string, unassigned []string) {
+
+	assigned = make(map[string][]string, len(portals))
+	unassigned = []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			unassigned = append(unassigned, item)
+			continue
+		}
+		portal := strings.TrimSpace(parts[0])
+		known := false
+		for _, name := range portals {
+			if name == portal {
+				known = true
+				break
+			}
+		}
+		if !known {
+			logW.Warn(fmt.Sprintf("'%s' is assigned to the portal '%s' which is not one of the home portals, ignoring it", parts[1], portal))
+			continue
+		}
+		assigned[portal] = append(assigned[portal], strings.TrimSpace(parts[1]))
+	}
+	return assigned, unassigned
+}
+
+// startSources starts the tecthulhus and concentrator along with the failover
+// that passes their statuses to the listener of statusC
+//
+func startSources(statusC chan *portalStatus, errorC chan error, quitC chan bool) (err error) {
+
+	// Sources are listed in order of preference, the concentrator being
+	// preferred over tecthulhus when it is healthy.  The failover passes
+	// on the statuses from the preferred healthy source for each portal
+	//
+	sources := []string{}
+	if len(*concAddress) != 0 {
+		sources = append(sources, *concAddress)
+	}
+
+	// The default tecthulhu is only watched when no other source was
+	// given, so a concentrator on its own is not failed over to a
+	// tecthulhu that is not there
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tecthulhus" {
+			given = true
+		}
+	})
+	if given || len(sources) == 0 {
+		sources = append(sources, strings.Split(*tecthulhus, ",")...)
+	}
+
+	sourceC := make(chan *portalStatus, 1)
+	fo := newFailover()
+
+	seen := map[string]bool{}
+	for i, uri := range sources {
+		uri = strings.TrimSpace(uri)
+		if len(uri) == 0 || seen[uri] {
+			continue
+		}
+		seen[uri] = true
+		isConcentrator := i == 0 && len(*concAddress) != 0
+
+		// Each source gets its own errors channel so that failures can
+		// be used to score its health
+		sourceErrC := make(chan error, 1)
+		source, err := newSource(uri, isConcentrator, sourceC, sourceErrC)
+		if err != nil {
+			return fmt.Errorf("%s could not be used due to %s", uri, err.Error())
+		}
+		fo.add(uri, sourceErrC, quitC)
+
+		go source.startPortals(quitC)
+	}
+
+	// Optionally keep a journal of everything received from the sources
+	// that can later be replayed
+	if len(*recordFile) != 0 {
+		recordedC := make(chan *portalStatus, 1)
+		if err := startRecorder(*recordFile, sourceC, recordedC, errorC, quitC); err != nil {
+			return fmt.Errorf("portal statuses could not be recorded to %s due to %s", *recordFile, err.Error())
+		}
+		sourceC = recordedC
+	}
+
+	go fo.run(sourceC, statusC, errorC, quitC)
+
+	return nil
+}
+
+// export writes the statuses for a portal from either a journal, or the live
+// sources, to a scenario directory returning the exit code for the gateway
+//
+func export(homePortal string, statusC chan *portalStatus, errorC chan error, quitC chan bool) (exitCode int) {
+
+	portal := *exportPortal
+	if len(portal) == 0 {
+		portal = homePortal
+	}
+
+	writer, err := newScenarioWriter(*exportDir, portal)
+	if err != nil {
+		logW.Error(err.Error())
+		return -1
+	}
+
+	if len(*exportJournal) != 0 {
+		err = exportFromJournal(*exportJournal, writer)
+	} else {
+		if err = startSources(statusC, errorC, quitC); err == nil {
+			err = exportFromSources(statusC, errorC, *exportWindow, writer, quitC)
+		}
+	}
+
+	if err != nil {
+		logW.Error(fmt.Sprintf("export to %s failed due to %s", *exportDir, err.Error()))
+		return -1
+	}
+	return 0
+}
+
 func main() {
 
 	flag.Parse()
@@ -54,14 +187,56 @@ func main() {
 
 	quitC := make(chan bool, 1)
 
-	// AUdio comes with 2 mixed channels of audio, ambientC is a looped
-	// playback that will interrupt ambient playback as a new file name
-	// is recieved, and sfxC is a single effect that will interrupt
-	// any other playing sfx file
-	ambientC := make(chan string, 1)
-	sfxC := make(chan []string, 1)
+	// Each of the home portals drives its own arduinos and audio
+	homes := []*homePortal{}
+	for _, name := range strings.Split(*homeTecthulhu, ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			homes = append(homes, newHomePortal(name))
+		}
+	}
+	if len(homes) == 0 {
+		logW.Fatal("No home portals were specified")
+		os.Exit(-1)
+	}
+	names := make([]string, 0, len(homes))
+	for _, home := range homes {
+		names = append(names, home.name)
+	}
+
+	registry, err := loadRegistry(*registryFile)
+	if err != nil {
+		logW.Fatal(err.Error())
+		os.Exit(-1)
+	}
+
+	rules, err := newRuleBook(*rulesFile)
+	if err != nil {
+		logW.Fatal(err.Error())
+		os.Exit(-1)
+	}
+	for _, home := range homes {
+		home.rules = rules
+	}
+
+	if len(*mqttBroker) != 0 {
+		sink := newMQTTSink(*mqttBroker, *mqttPrefix)
+		for _, home := range homes {
+			home.mqtt = sink
+		}
+	}
 
-	initAudio(ambientC, sfxC, quitC)
+	// If someone presses ctrl C then close our quitc channel to shutdown the system
+	// in an orderly way especially when dealing with device handles for the serial IO
+	//
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		select {
+		case <-quitC:
+		case <-sigC:
+			close(quitC)
+		}
+	}()
 
 	// portals encapsulate a JSon data feed from ingress nodes, that 
 	// contains up to approximately 4 seconds of status updates
@@ -69,47 +244,52 @@ func main() {
 	statusC := make(chan *portalStatus, 1)
 	errorC := make(chan error, 1)
 
-	portals := strings.Split(*tecthulhus, ",")
+	// When exporting a scenario the gateway does not drive any devices
+	if len(*exportDir) != 0 {
+		os.Exit(export(names[0], statusC, errorC, quitC))
+	}
 
-	if len(*concAddress) != 0 {
-		conc := &concentrator{
-			url:     *concAddress,
-			statusC: statusC,
-			errorC:  errorC,
+	board := newLeaderboard(*leaderboardFile, names)
+	for _, home := range homes {
+		home.board = board
+	}
+	if len(*apiAddress) != 0 {
+		go startAPI(*apiAddress, board, errorC)
+	}
+
+	// Portals without their own sounds use the default directory
+	audioDirs, defaultDirs := parsePortalList(*audioDir, names)
+	for _, home := range homes {
+		dir := defaultAudioDir
+		if len(defaultDirs) != 0 {
+			dir = defaultDirs[0]
 		}
-		go conc.startPortals(quitC)
-	} else {
-		tec := &tecthulhu{
-			url:     portals[0],
-			statusC: statusC,
-			errorC:  errorC,
+		if dirs, ok := audioDirs[home.name]; ok {
+			dir = dirs[0]
 		}
-		go tec.startPortals(quitC)
+
+		// AUdio comes with 2 mixed channels of audio, ambientC is a looped
+		// playback that will interrupt ambient playback as a new file name
+		// is recieved, and sfxC is a single effect that will interrupt
+		// any other playing sfx file
+		initAudio(dir, home.ambientC, home.sfxC, quitC)
+	}
+
+	if err := startSources(statusC, errorC, quitC); err != nil {
+		logW.Fatal(err.Error())
+		os.Exit(-1)
 	}
 
 	// Create a channel over which notifications will be sent for new
 	// arduino devices that are detected, the gateway listens
 	// for these and uses them for sending updates to the portal state
 	//
-	go plugAndPlay(quitC)
+	go plugAndPlay(names, registry, quitC)
 
 	// The gateway bridges the status reports from portals down to arduinos
 	// using the serial protocols defined by the arduino team
 	//
-	go startGateway(*homeTecthulhu, statusC, ambientC, sfxC, quitC)
-
-	// If someone presses ctrl C then close our quitc channel to shutdown the system
-	// in an orderly way especially when dealing with device handles for the serial IO
-	//
-	sigC := make(chan os.Signal, 1)
-	signal.Notify(sigC, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		select {
-		case <-quitC:
-		case <-sigC:
-			close(quitC)
-		}
-	}()
+	go startGateway(homes, statusC, quitC)
 
 	// Having started all of the IO interfaces concurrently simply loop
 	// waiting for any changes in state while the processing occurs
@@ -119,9 +299,11 @@ func main() {
 		case err := <-errorC:
 			logW.Warn(err.Error())
 		case <-quitC:
-			for _, dev := range getRunningDevices(*homeTecthulhu) {
-				stopRunningDevice(*homeTecthulhu, dev.devName)
-				logW.Warn(fmt.Sprintf("closing portal %s attached to device %s acting as a %s", *homeTecthulhu, dev.devName, dev.role))
+			for _, home := range homes {
+				for key, dev := range getRunningDevices(home.name) {
+					stopRunningDevice(home.name, key)
+					logW.Warn(fmt.Sprintf("closing portal %s attached to device %s acting as a %s", home.name, dev.devName, dev.role))
+				}
 			}
 			return
 		}
@@ -0,0 +1,111 @@
+package main
+
+// This module implements the catalog of the mods that can be deployed on a
+// portal.  Each entry relates the canonical type and rarity used by the
+// concentrator, the short code used by the tecthulhu, and the character used
+// for the mod in the lines sent to the arduinos.  The tecthulhu adapter, the
+// concentrator model and the arduino encoders all use the catalog so that a
+// mod is described the same way throughout the gateway.  The scenarios under
+// simulator/scenarios are checked against the catalog by go test.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// modKind describes one type and rarity of mod
+//
+type modKind struct {
+	code   string // The tecthulhu code
+	typ    string // The canonical type
+	rarity string // The canonical rarity
+	proto  byte   // The character used in the arduino lines
+}
+
+// modCatalog lists every mod known to the gateway.  Mods that are only found
+// in a single rarity are given the short code without a rarity suffix
+var modCatalog = []modKind{
+	{code: "FA", typ: "Force Amplifier", rarity: "Rare", proto: '0'},
+	{code: "HS-C", typ: "Heat Sink", rarity: "Common", proto: '1'},
+	{code: "HS-R", typ: "Heat Sink", rarity: "Rare", proto: '2'},
+	{code: "HS-VR", typ: "Heat Sink", rarity: "Very Rare", proto: '3'},
+	{code: "LA-R", typ: "Link Amplifier", rarity: "Rare", proto: '4'},
+	{code: "LA-VR", typ: "Link Amplifier", rarity: "Very Rare", proto: '5'},
+	{code: "SBUL", typ: "SoftBank UltraLink", rarity: "Very Rare", proto: '6'},
+	{code: "MH-C", typ: "Multi-hack", rarity: "Common", proto: '7'},
+	{code: "MH-R", typ: "Multi-hack", rarity: "Rare", proto: '8'},
+	{code: "MH-VR", typ: "Multi-hack", rarity: "Very Rare", proto: '9'},
+	{code: "PS-C", typ: "Portal Shield", rarity: "Common", proto: 'A'},
+	{code: "PS-R", typ: "Portal Shield", rarity: "Rare", proto: 'B'},
+	{code: "PS-VR", typ: "Portal Shield", rarity: "Very Rare", proto: 'C'},
+	{code: "AXA", typ: "AXA Shield", rarity: "Very Rare", proto: 'D'},
+	{code: "T", typ: "Turret", rarity: "Rare", proto: 'E'},
+}
+
+// rarityCodes are the suffixes used by the tecthulhu codes for each rarity
+var rarityCodes = map[string]string{
+	"C":  "Common",
+	"R":  "Rare",
+	"VR": "Very Rare",
+}
+
+// modByCode finds the mod for a tecthulhu code.  Codes for mods found in a
+// single rarity are also accepted with the rarity suffix, for example FA-R
+//
+func modByCode(code string) (kind *modKind, ok bool) {
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for i := range modCatalog {
+		if modCatalog[i].code == code {
+			return &modCatalog[i], true
+		}
+	}
+
+	if parts := strings.Split(code, "-"); len(parts) == 2 {
+		if rarity, ok := rarityCodes[parts[1]]; ok {
+			for i := range modCatalog {
+				if modCatalog[i].code == parts[0] && modCatalog[i].rarity == rarity {
+					return &modCatalog[i], true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// modByName finds the mod for a canonical type and rarity.  The rarity may be
+// left out for mods found in a single rarity
+//
+func modByName(typ string, rarity string) (kind *modKind, ok bool) {
+
+	var found *modKind
+	matches := 0
+
+	for i := range modCatalog {
+		if !strings.EqualFold(modCatalog[i].typ, typ) {
+			continue
+		}
+		if strings.EqualFold(modCatalog[i].rarity, rarity) {
+			return &modCatalog[i], true
+		}
+		found = &modCatalog[i]
+		matches++
+	}
+	if len(rarity) == 0 && matches == 1 {
+		return found, true
+	}
+	return nil, false
+}
+
+// checkMods returns a description of each of the mods in the status that is
+// not in the catalog
+//
+func checkMods(state *portalStatus) (unknown []string) {
+	unknown = []string{}
+	for _, m := range state.Status.Mods {
+		if _, ok := modByName(m.Type, m.Rarity); !ok {
+			unknown = append(unknown, strings.TrimSpace(fmt.Sprintf("%s %s", m.Rarity, m.Type)))
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,290 @@
+package main
+
+// This module implements the MQTT integration of the gateway.  Portal status
+// can be received by subscribing to a topic on a broker, using a URI such as
+// mqtt://broker:1883/camp/portal/status as one of the tecthulhus, with each
+// message containing a single tecthulhu JSon document.  Wildcards in the topic
+// need to be URI encoded, for example %23 for '#'.  mqtts:// URIs use TLS.
+//
+// The gateway can also publish what it derives from the portal status to a
+// broker, specified using the -mqtt option.  Topics take the form
+// <prefix>/<portal>/<item> where the prefix is set using the -mqttTopic option.
+// The items published are,
+//
+//   faction    - the controlling faction, retained, published when it changes
+//   resonators - a JSon array of the resonators, retained, published when they change
+//   command    - the ASCII line sent to the arduinos, published when it changes
+//   events     - each portal event as a JSon document
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	mqttBroker = flag.String("mqtt", "", "The address of an MQTT broker, for example tcp://127.0.0.1:1883, to which portal changes and arduino commands are published")
+	mqttPrefix = flag.String("mqttTopic", "pi-gateway", "The prefix for the topics published to the MQTT broker")
+)
+
+// mqttClients counts the clients created by this process, brokers disconnect
+// the existing client when another connects using the same identifier
+var mqttClients uint64
+
+// mqttClientID generates a client identifier that is unique to each client
+// within this gateway process
+//
+func mqttClientID(role string) (id string) {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("pi-gateway-%s-%s-%d-%d", role, host, os.Getpid(), atomic.AddUint64(&mqttClients, 1))
+}
+
+// mqttBrokerURL converts an mqtt:// or mqtts:// URI to the broker address
+// used by the client
+//
+func mqttBrokerURL(srcURL *url.URL) (broker string, err error) {
+	switch srcURL.Scheme {
+	case "mqtt":
+		return "tcp://" + srcURL.Host, nil
+	case "mqtts":
+		return "ssl://" + srcURL.Host, nil
+	}
+	return "", fmt.Errorf("Unknown scheme %s for an MQTT URI", srcURL.Scheme)
+}
+
+type mqttSource struct {
+	url     string
+	statusC chan *portalStatus
+	errorC  chan error
+}
+
+// startPortals subscribes to the topic and passes each status received to
+// the gateway.  The client reconnects, and resubscribes, on its own after
+// losing the broker
+//
+func (src *mqttSource) startPortals(quitC chan bool) (err error) {
+
+	srcURL, err := url.Parse(src.url)
+	if err != nil {
+		publishError(fmt.Errorf("MQTT source %s could not be used due to %s", src.url, err.Error()), src.errorC)
+		return err
+	}
+	broker, err := mqttBrokerURL(srcURL)
+	if err != nil {
+		publishError(err, src.errorC)
+		return err
+	}
+	topic := strings.TrimPrefix(srcURL.Path, "/")
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(mqttClientID("source")).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectTimeout(*connectTimeout).
+		SetMaxReconnectInterval(*maxBackoff).
+		SetKeepAlive(*staleAfter / 2)
+
+	if srcURL.User != nil {
+		opts.SetUsername(srcURL.User.Username())
+		if password, ok := srcURL.User.Password(); ok {
+			opts.SetPassword(password)
+		}
+	}
+
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		publishError(fmt.Errorf("MQTT source %s lost the broker due to %s", src.url, err.Error()), src.errorC)
+	})
+
+	// Subscriptions are made every time the client connects as
+	// clean sessions are being used
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		token := client.Subscribe(topic, 0, src.receive)
+		go func() {
+			if token.Wait() && token.Error() != nil {
+				publishError(fmt.Errorf("MQTT source %s could not subscribe due to %s", src.url, token.Error().Error()), src.errorC)
+				return
+			}
+			logW.Info(fmt.Sprintf("subscribed to %s on %s", topic, broker))
+		}()
+	})
+
+	client := mqtt.NewClient(opts)
+	defer client.Disconnect(250)
+
+	// Keep trying to connect until the broker becomes available, after
+	// which the client takes care of reconnecting
+	for {
+		token := client.Connect()
+		if token.Wait() && token.Error() == nil {
+			break
+		}
+		publishError(fmt.Errorf("MQTT source %s could not connect due to %s", src.url, token.Error().Error()), src.errorC)
+
+		select {
+		case <-time.After(*maxBackoff / 4):
+		case <-quitC:
+			return nil
+		}
+	}
+
+	// Statuses are only published by the broker when they change, a quiet
+	// topic is kept from appearing stale for as long as the connection, which
+	// is checked using the MQTT keepalive, remains open
+	for {
+		select {
+		case <-time.After(*pollInterval):
+			if client.IsConnectionOpen() {
+				publishAlive(src.url)
+			}
+		case <-quitC:
+			return nil
+		}
+	}
+}
+
+func (src *mqttSource) receive(client mqtt.Client, msg mqtt.Message) {
+	status, err := decodeTecthulhu(msg.Payload())
+	if err != nil {
+		publishError(fmt.Errorf("MQTT source %s sent bad data on %s %s", src.url, msg.Topic(), err.Error()), src.errorC)
+		return
+	}
+
+	publishStatus(src.url, status, src.statusC, src.errorC)
+}
+
+// mqttSink publishes the changes to a portal, and the commands sent to its
+// arduinos, to an MQTT broker
+//
+type mqttSink struct {
+	client mqtt.Client
+	prefix string
+
+	// The last value published to each topic
+	published map[string]string
+	sync.Mutex
+}
+
+func newMQTTSink(broker string, prefix string) (sink *mqttSink) {
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(mqttClientID("sink")).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectTimeout(*connectTimeout).
+		SetMaxReconnectInterval(*maxBackoff)
+
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		logW.Warn(fmt.Sprintf("MQTT broker %s was lost due to %s", broker, err.Error()))
+	})
+
+	sink = &mqttSink{
+		client:    mqtt.NewClient(opts),
+		prefix:    strings.TrimSuffix(prefix, "/"),
+		published: map[string]string{},
+	}
+
+	// Keep trying to connect in the background until the broker becomes
+	// available, after which the client takes care of reconnecting
+	go func() {
+		for {
+			token := sink.client.Connect()
+			if token.Wait() && token.Error() == nil {
+				logW.Info(fmt.Sprintf("publishing to MQTT broker %s", broker))
+				return
+			}
+			logW.Warn(fmt.Sprintf("MQTT broker %s could not be connected due to %s", broker, token.Error().Error()))
+			time.Sleep(*maxBackoff / 4)
+		}
+	}()
+
+	return sink
+}
+
+// topic returns the topic for an item of a portal, characters in the portal
+// name that have special meaning in topics are replaced
+//
+func (sink *mqttSink) topic(portal string, item string) string {
+	portal = strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(portal)
+	return sink.prefix + "/" + portal + "/" + item
+}
+
+// publish sends the payload to the topic when it differs from the previous
+// payload sent to it
+//
+func (sink *mqttSink) publish(portal string, item string, payload string, retained bool) {
+
+	if !sink.client.IsConnected() {
+		return
+	}
+
+	topic := sink.topic(portal, item)
+
+	sink.Lock()
+	unchanged := sink.published[topic] == payload
+	sink.published[topic] = payload
+	sink.Unlock()
+
+	if unchanged {
+		return
+	}
+
+	token := sink.client.Publish(topic, 0, retained, payload)
+	go func() {
+		if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+			logW.Warn(fmt.Sprintf("MQTT publish to %s failed due to %s", topic, token.Error().Error()))
+		}
+	}()
+}
+
+// publishState publishes the faction and resonators of the portal
+//
+func (sink *mqttSink) publishState(state *portalStatus) {
+
+	sink.publish(state.Status.Title, "faction", state.Status.ControllingFaction, true)
+
+	resonators, err := json.Marshal(state.Status.Resonators)
+	if err != nil {
+		logW.Warn(err.Error())
+		return
+	}
+	sink.publish(state.Status.Title, "resonators", string(resonators), true)
+}
+
+// publishCommand publishes the line sent to the arduinos of the portal
+//
+func (sink *mqttSink) publishCommand(portal string, cmd []byte) {
+	sink.publish(portal, "command", strings.TrimSpace(string(cmd)), false)
+}
+
+// publishEvent publishes a single event for the portal
+//
+func (sink *mqttSink) publishEvent(ev *portalEvent) {
+
+	if !sink.client.IsConnected() {
+		return
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		logW.Warn(err.Error())
+		return
+	}
+
+	topic := sink.topic(ev.Portal, "events")
+	token := sink.client.Publish(topic, 0, false, payload)
+	go func() {
+		if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+			logW.Warn(fmt.Sprintf("MQTT publish to %s failed due to %s", topic, token.Error().Error()))
+		}
+	}()
+}
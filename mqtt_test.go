@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// mockBroker is just enough of an MQTT broker to connect, subscribe and
+// publish using QoS 0
+//
+type mockBroker struct {
+	listener net.Listener
+
+	clientIDs   chan string
+	subscribedC chan string
+	publishedC  chan *packets.PublishPacket
+
+	subscribers map[net.Conn][]string
+	sync.Mutex
+}
+
+func newMockBroker(t *testing.T) (broker *mockBroker) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker = &mockBroker{
+		listener:    listener,
+		clientIDs:   make(chan string, 10),
+		subscribedC: make(chan string, 10),
+		publishedC:  make(chan *packets.PublishPacket, 100),
+		subscribers: map[net.Conn][]string{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (broker *mockBroker) close() {
+	broker.listener.Close()
+
+	broker.Lock()
+	defer broker.Unlock()
+	for conn := range broker.subscribers {
+		conn.Close()
+	}
+}
+
+// write sends a packet to a client, packets are written with the lock held so
+// that they are not interleaved
+//
+func (broker *mockBroker) write(conn net.Conn, packet packets.ControlPacket) {
+	broker.Lock()
+	defer broker.Unlock()
+	packet.Write(conn)
+}
+
+func (broker *mockBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	broker.Lock()
+	broker.subscribers[conn] = []string{}
+	broker.Unlock()
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch packet := packet.(type) {
+		case *packets.ConnectPacket:
+			broker.clientIDs <- packet.ClientIdentifier
+			broker.write(conn, packets.NewControlPacket(packets.Connack))
+
+		case *packets.SubscribePacket:
+			broker.Lock()
+			broker.subscribers[conn] = append(broker.subscribers[conn], packet.Topics...)
+			broker.Unlock()
+
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = packet.MessageID
+			ack.ReturnCodes = packet.Qoss
+			broker.write(conn, ack)
+
+			for _, topic := range packet.Topics {
+				broker.subscribedC <- topic
+			}
+
+		case *packets.PublishPacket:
+			broker.publishedC <- packet
+			broker.send(packet.TopicName, string(packet.Payload))
+
+		case *packets.PingreqPacket:
+			broker.write(conn, packets.NewControlPacket(packets.Pingresp))
+
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// send publishes the payload to the clients subscribed to the topic
+//
+func (broker *mockBroker) send(topic string, payload string) {
+	broker.Lock()
+	defer broker.Unlock()
+
+	for conn, topics := range broker.subscribers {
+		for _, subscribed := range topics {
+			if subscribed != topic {
+				continue
+			}
+			packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			packet.TopicName = topic
+			packet.Payload = []byte(payload)
+			packet.Write(conn)
+		}
+	}
+}
+
+// expectPublish waits for the next message published to the broker
+//
+func (broker *mockBroker) expectPublish(t *testing.T, topic string, payload string, retained bool) {
+	select {
+	case packet := <-broker.publishedC:
+		if packet.TopicName != topic || string(packet.Payload) != payload || packet.Retain != retained {
+			t.Fatalf("expected '%s' to be published to %s (retained %t), not '%s' to %s (retained %t)",
+				payload, topic, retained, string(packet.Payload), packet.TopicName, packet.Retain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for '%s' to be published to %s", payload, topic)
+	}
+}
+
+func TestMQTTClientID(t *testing.T) {
+	if first, second := mqttClientID("source"), mqttClientID("source"); first == second {
+		t.Fatalf("two clients were both given the identifier %s", first)
+	}
+}
+
+func TestMQTTSource(t *testing.T) {
+
+	broker := newMockBroker(t)
+	defer broker.close()
+
+	uri := "mqtt://" + broker.listener.Addr().String() + "/camp/portal/status"
+	statusC, _, stop := streamSource(t, uri)
+	defer stop()
+
+	select {
+	case topic := <-broker.subscribedC:
+		if topic != "camp/portal/status" {
+			t.Fatalf("expected a subscription to camp/portal/status, not %s", topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the source did not subscribe")
+	}
+
+	broker.send("camp/portal/status", streamDoc("A"))
+	expectTitle(t, statusC, uri, "A")
+	broker.send("camp/portal/status", streamDoc("B"))
+	expectTitle(t, statusC, uri, "B")
+}
+
+func TestMQTTSink(t *testing.T) {
+
+	broker := newMockBroker(t)
+	defer broker.close()
+
+	sink := newMQTTSink("tcp://"+broker.listener.Addr().String(), "camp/")
+	defer sink.client.Disconnect(0)
+
+	for start := time.Now(); !sink.client.IsConnectionOpen(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the sink did not connect")
+		}
+	}
+
+	state := &portalStatus{Status: status{
+		Title:              "Camp/Navarro",
+		ControllingFaction: "1",
+		Resonators:         []resonator{{Position: "N", Level: 8, Health: 100}},
+	}}
+	sink.publishState(state)
+	broker.expectPublish(t, "camp/Camp_Navarro/faction", "1", true)
+	broker.expectPublish(t, "camp/Camp_Navarro/resonators", `[{"position":"N","level":8,"health":100,"owner":""}]`, true)
+
+	// Only the items that change are published again
+	sink.publishState(state)
+	state.Status.ControllingFaction = "2"
+	sink.publishState(state)
+	broker.expectPublish(t, "camp/Camp_Navarro/faction", "2", true)
+
+	sink.publishCommand("Camp/Navarro", []byte("E:50\n"))
+	broker.expectPublish(t, "camp/Camp_Navarro/command", "E:50", false)
+}
@@ -6,10 +6,15 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"time"
 )
 
+// deviceCatalog holds the running devices of each portal, indexed by the
+// identity of the device given by the registry so that a board is only run
+// once even when it has been plugged back in under a new name
+//
 type deviceCatalog struct {
 	devices map[string]map[string]*arduino
 	sync.Mutex
@@ -19,63 +24,183 @@ var devices = deviceCatalog{
 	devices: map[string]map[string]*arduino{},
 }
 
-func plugAndPlay(quitC chan bool) {
+func plugAndPlay(portals []string, registry *deviceRegistry, quitC chan bool) {
 
-	devices.devices = map[string]map[string]*arduino{*homeTecthulhu: map[string]*arduino{}}
+	devices.Lock()
+	devices.devices = make(map[string]map[string]*arduino, len(portals))
+	for _, portal := range portals {
+		devices.devices[portal] = map[string]*arduino{}
+	}
+	devices.Unlock()
+
+	// Use the kernel uevents when possible, otherwise rely upon rescanning
+	var ueventC chan *uevent
+	rescan := *rescanPeriod
+	if *hotplug {
+		var err error
+		if ueventC, err = watchUevents(quitC); err != nil {
+			logW.Warn(fmt.Sprintf("%s, rescanning for arduinos every %s", err.Error(), rescan.String()))
+		} else {
+			rescan = hotplugRescan
+		}
+	}
 
-	candidates := map[string]map[string]bool{*homeTecthulhu: map[string]bool{}}
+	for {
+		scanDevices(portals, registry)
+
+		// Scan again early when a device in backoff is due to be retried
+		wait := rescan
+		if retry, ok := states.nextRetry(); ok && retry < wait {
+			wait = retry
+		}
+
+		closed, quit := awaitRescan(portals, wait, ueventC, quitC)
+		if quit {
+			return
+		}
+		if closed {
+			ueventC = nil
+			rescan = *rescanPeriod
+		}
+	}
+}
+
+// awaitRescan waits until the devices are next to be scanned, which is once
+// the wait is over or a device has been added or removed.  Unplugged devices
+// are stopped straight away.  Other uevents, such as change and bind, do not
+// cause a scan.  closed indicates that the uevents are no longer available
+//
+func awaitRescan(portals []string, wait time.Duration, ueventC chan *uevent, quitC chan bool) (closed bool, quit bool) {
+
+	due := time.After(wait)
 
 	for {
-		for _, device := range findDevices() {
-			// At the moment we only control a single portals audrinos however
-			// this can be changed very simply by using multiple names here
-			candidates[*homeTecthulhu][device] = true
+		select {
+		case <-due:
+			return false, false
+		case ev, ok := <-ueventC:
+			if !ok {
+				return true, false
+			}
+			logW.Debug(fmt.Sprintf("uevent %s for %s", ev.action, ev.devPath()))
+
+			switch ev.action {
+			case "add":
+				waitForNode(ev.devPath(), time.Second)
+				return false, false
+			case "remove":
+				for _, portal := range portals {
+					for key, dev := range getRunningDevices(portal) {
+						if dev.devName != ev.devPath() {
+							continue
+						}
+						// A device unplugged soon after it started counts
+						// as a failure so that a board that keeps resetting
+						// is backed off
+						logW.Info(fmt.Sprintf("arduino at %s for %s was unplugged", ev.devPath(), portal))
+						states.unplugged(key)
+						stopRunningDevice(portal, key)
+					}
+				}
+				return false, false
+			}
+		case <-quitC:
+			return false, true
 		}
+	}
+}
 
+// waitForNode waits for the device node of a newly added device to be
+// created by udev
+//
+func waitForNode(path string, limit time.Duration) {
+	for deadline := time.Now().Add(limit); time.Now().Before(deadline); {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// scanDevices finds the devices for each of the portals and starts those
+// that are not already running
+//
+func scanDevices(portals []string, registry *deviceRegistry) {
+
+	// The devices found by the scan that are not yet running, indexed by
+	// their identity, giving their device name
+	candidates := make(map[string]map[string]string, len(portals))
+	for _, portal := range portals {
+		candidates[portal] = map[string]string{}
+	}
+	for portal, devNames := range findDevices(portals, registry) {
+		for _, device := range devNames {
+			candidates[portal][registry.identity(device)] = device
+		}
+	}
+
+	for _, portal := range portals {
 		// Get the current catalog of open working devices
-		working := getRunningDevices(*homeTecthulhu)
+		working := getRunningDevices(portal)
 
 		// Check if the device is new, and if so try starting it
-		for _, device := range working {
-			if _, ok := candidates[*homeTecthulhu][device.devName]; ok {
-				delete(candidates[*homeTecthulhu], device.devName)
+		for key, device := range working {
+			if _, ok := candidates[portal][key]; ok {
+				delete(candidates[portal], key)
 			} else {
 				logW.Info(fmt.Sprintf("Discovered %s", device.devName))
 			}
 		}
+	}
 
-		for portalName, devNames := range candidates {
-			for name := range devNames {
+	for portalName, devNames := range candidates {
+		for key, name := range devNames {
 
-				device, err := startDevice(portalName, name)
-				if err != nil {
-					stopRunningDevice(portalName, name)
-					continue
-				}
+			entry, settings := registry.lookup(name)
 
-				if func() bool {
-					devices.Lock()
-					defer devices.Unlock()
-					if _, ok := devices.devices[portalName][name]; !ok {
-						devices.devices[portalName][name] = device
-						return true
-					} else {
-						device.close()
-					}
-					return false
-				}() {
-					logW.Info(fmt.Sprintf("arduino at %s has the role of '%s'", device.devName, device.role))
+			// Devices that have failed recently wait for their backoff,
+			// and quarantined devices wait to be cleared
+			registered := ""
+			if entry != nil {
+				registered = entry.Name
+			}
+			if !states.connect(key, name, registered) {
+				continue
+			}
+
+			// A device that has gone by the time it is opened was
+			// unplugged rather than having failed
+			device, err := startDevice(portalName, name, key, entry, settings)
+			if err != nil {
+				if os.IsNotExist(err) {
+					states.unplugged(key)
+				} else {
+					states.failed(key, err)
 				}
+				continue
+			}
+			states.online(key)
+
+			if func() bool {
+				devices.Lock()
+				defer devices.Unlock()
+				if _, ok := devices.devices[portalName][key]; !ok {
+					devices.devices[portalName][key] = device
+					return true
+				} else {
+					device.close()
+				}
+				return false
+			}() {
+				logW.Info(fmt.Sprintf("arduino %s has the role of '%s' for %s, using the %s encoding", device.label(), device.role, portalName, encoderFor(device.role).name))
 			}
-		}
-		select {
-		case <-time.After(10 * time.Second):
-		case <-quitC:
-			return
 		}
 	}
 }
 
+// getRunningDevices returns the running devices of the portal indexed by
+// their identity
+//
 func getRunningDevices(portal string) (devs map[string]*arduino) {
 	devices.Lock()
 	defer devices.Unlock()
@@ -87,22 +212,38 @@ func getRunningDevices(portal string) (devs map[string]*arduino) {
 	}
 
 	devs = make(map[string]*arduino, len(found))
-	for deviceName, device := range found {
-		devs[deviceName] = device
+	for key, device := range found {
+		devs[key] = device
 	}
 	return devs
 }
 
-func stopRunningDevice(portal string, device string) {
+// stopRunningDevice takes the device with the identity given by key offline.
+// The device is closed after the catalog has been unlocked as closing a device
+// blocks until a write that is in progress completes
+//
+func stopRunningDevice(portal string, key string) {
 	defer func() {
 		recover()
 	}()
 
 	devices.Lock()
-	defer devices.Unlock()
+	dev, ok := devices.devices[portal][key]
+	if ok {
+		delete(devices.devices[portal], key)
+	}
+	devices.Unlock()
 
-	if dev, ok := devices.devices[portal][device]; ok {
-		delete(devices.devices[portal], device)
+	if ok {
 		dev.close()
 	}
 }
+
+// offline takes the device offline after a line could not be written to it,
+// which counts as a failure of the device
+//
+func (dev *arduino) offline(line []byte, err error) {
+	logW.Warn(fmt.Sprintf("%q ➡  device %s role '%s' got an error %s, taking device offline", line, dev.devName, dev.role, err.Error()))
+	states.failed(dev.key, err)
+	stopRunningDevice(dev.portal, dev.key)
+}
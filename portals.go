@@ -0,0 +1,111 @@
+package main
+
+// This module contains functions shared by the various sources of portal
+// status information, tecthulhus, concentrators and the like, for handing
+// their results to the gateway
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// portalSource is implemented by the tecthulhus, concentrators and other
+// sources of portal status information
+//
+type portalSource interface {
+	startPortals(quitC chan bool) (err error)
+}
+
+// newSource creates a source of portal status information based upon the
+// scheme of the URI, the concentrator flag indicating that the source uses
+// the concentrator rather than the tecthulhu JSon format
+//
+func newSource(uri string, concentratorFormat bool, statusC chan *portalStatus, errorC chan error) (source portalSource, err error) {
+
+	sourceURL, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sourceURL.Scheme {
+	case "ws", "wss", "sse+http", "sse+https":
+		return newStreamer(uri, concentratorFormat, statusC, errorC)
+	case "scenario":
+		return &scenario{url: uri, statusC: statusC, errorC: errorC}, nil
+	case "replay":
+		return &replay{url: uri, statusC: statusC, errorC: errorC}, nil
+	case "mqtt", "mqtts":
+		return &mqttSource{url: uri, statusC: statusC, errorC: errorC}, nil
+	}
+
+	if concentratorFormat {
+		return &concentrator{url: uri, statusC: statusC, errorC: errorC}, nil
+	}
+	return &tecthulhu{url: uri, statusC: statusC, errorC: errorC}, nil
+}
+
+// liveness records when each source was last known to be working.  Sources
+// that push updates only do so when a portal changes, so these also record
+// the keepalives, pings and the like that show a quiet source is still up
+//
+var liveness = struct {
+	seen map[string]time.Time
+	sync.Mutex
+}{
+	seen: map[string]time.Time{},
+}
+
+// publishAlive records that the source is working even though it may have
+// nothing new to report
+//
+func publishAlive(source string) {
+	liveness.Lock()
+	liveness.seen[source] = time.Now()
+	liveness.Unlock()
+}
+
+// lastAlive returns the time the source was last known to be working, the
+// zero time if it never has been
+//
+func lastAlive(source string) (seen time.Time) {
+	liveness.Lock()
+	defer liveness.Unlock()
+	return liveness.seen[source]
+}
+
+// publishStatus tags a freshly retrieved portal status with its source and
+// hands it to the listener of the status channel, and if the listener is not
+// keeping up reports the skipped update using the error channel.  The status
+// is copied before being tagged as the caller may hold on to it
+//
+func publishStatus(source string, status *portalStatus, statusC chan *portalStatus, errorC chan error) {
+	tagged := *status
+	tagged.Source = source
+
+	select {
+	case statusC <- &tagged:
+	case <-time.After(750 * time.Millisecond):
+		go func() {
+			select {
+			case errorC <- fmt.Errorf("portal status for %s had to be skipped", source):
+			case <-time.After(2 * time.Second):
+				logW.Warn("could not send error for ignored portal status update")
+			}
+		}()
+	}
+}
+
+// publishError reports a failure to retrieve portal status without blocking
+// the caller
+//
+func publishError(err error, errorC chan error) {
+	go func() {
+		select {
+		case errorC <- err:
+		case <-time.After(500 * time.Millisecond):
+			logW.Warn(fmt.Sprintf("could not send, error for ignored portal status update %s", err.Error()))
+		}
+	}()
+}
@@ -0,0 +1,234 @@
+package main
+
+// This module implements the registry of known arduinos.  The registry is a
+// JSon file, given using the -registry option, that identifies boards by their
+// USB serial number, which unlike the /dev/ttyACMn name of a board does not
+// change when the board is plugged back in.  For example,
+//
+//   {
+//       "devices": [
+//           {"serial": "85531303", "name": "north resonators", "portal": "Camp Navarro", "role": "Magnus Resonators Node", "baud": 9600}
+//       ]
+//   }
+//
+// Registered boards are always tried as arduinos, are assigned to their portal,
+// are opened using their serial settings and are checked for the expected role.
+// The name is used when logging the board.  A warning is logged when a
+// registered board is missing, and again when it returns.  The registry can
+// also hold profiles giving the serial settings for boards by their USB vendor
+// and product IDs, see serialconfig.go.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var (
+	registryFile = flag.String("registry", "", "A JSon file of the known arduinos identified by USB serial number, giving their name, portal, role and serial settings")
+)
+
+type registeredDevice struct {
+	Serial string `json:"serial"`
+	Name   string `json:"name"`
+	Portal string `json:"portal"`
+	Role   string `json:"role"`
+	serialSettings
+}
+
+type deviceRegistry struct {
+	Devices  []*registeredDevice `json:"devices"`
+	Profiles []*serialProfile    `json:"profiles"`
+
+	bySerial map[string]*registeredDevice
+
+	// The USB serial devices found by the last scan, by device name
+	byPath map[string]usbSerialDevice
+
+	// The registered boards known to be missing
+	missing map[string]bool
+	sync.Mutex
+}
+
+// loadRegistry reads the registry file, an empty registry is used when no
+// file is given
+//
+func loadRegistry(file string) (registry *deviceRegistry, err error) {
+
+	registry = &deviceRegistry{
+		Devices:  []*registeredDevice{},
+		Profiles: []*serialProfile{},
+		bySerial: map[string]*registeredDevice{},
+		byPath:   map[string]usbSerialDevice{},
+		missing:  map[string]bool{},
+	}
+
+	if len(file) == 0 {
+		return registry, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, registry); err != nil {
+		return nil, fmt.Errorf("device registry %s could not be decoded due to %s", file, err.Error())
+	}
+
+	names := map[string]bool{}
+	for i, entry := range registry.Devices {
+		if entry == nil || len(entry.Serial) == 0 {
+			return nil, fmt.Errorf("device %d in %s has no serial number", i+1, file)
+		}
+		if _, dup := registry.bySerial[entry.Serial]; dup {
+			return nil, fmt.Errorf("device serial number %s appears more than once in %s", entry.Serial, file)
+		}
+		if err = entry.check(); err != nil {
+			return nil, fmt.Errorf("device serial number %s in %s has bad serial settings, %s", entry.Serial, file, err.Error())
+		}
+		if len(entry.Name) == 0 {
+			entry.Name = entry.Serial
+		}
+		// The name is used to tell the boards apart in the logs
+		if names[entry.Name] {
+			return nil, fmt.Errorf("device name '%s' appears more than once in %s", entry.Name, file)
+		}
+		names[entry.Name] = true
+		registry.bySerial[entry.Serial] = entry
+	}
+
+	for i, profile := range registry.Profiles {
+		if profile == nil || len(profile.Vendor) == 0 {
+			return nil, fmt.Errorf("profile %d in %s has no vendor ID", i+1, file)
+		}
+		if err = profile.check(); err != nil {
+			return nil, fmt.Errorf("profile %d in %s has bad serial settings, %s", i+1, file, err.Error())
+		}
+		// Only the first profile matching a board is used, so a later
+		// profile for the same IDs would never be
+		for _, earlier := range registry.Profiles[:i] {
+			if strings.EqualFold(earlier.Vendor, profile.Vendor) && (len(earlier.Product) == 0 || strings.EqualFold(earlier.Product, profile.Product)) {
+				return nil, fmt.Errorf("profile %d in %s for %s:%s is hidden by an earlier profile", i+1, file, profile.Vendor, profile.Product)
+			}
+		}
+	}
+
+	logW.Info(fmt.Sprintf("loaded %d devices and %d profiles from %s", len(registry.Devices), len(registry.Profiles), file))
+	return registry, nil
+}
+
+// empty tests whether any boards or profiles have been registered
+//
+func (registry *deviceRegistry) empty() bool {
+	return len(registry.Devices) == 0 && len(registry.Profiles) == 0
+}
+
+// identify returns the registry entry for a USB serial device
+//
+func (registry *deviceRegistry) identify(dev *usbSerialDevice) (entry *registeredDevice, ok bool) {
+	if len(dev.Serial) == 0 {
+		return nil, false
+	}
+	entry, ok = registry.bySerial[dev.Serial]
+	return entry, ok
+}
+
+// known tests whether a USB serial device is registered or matches one of the
+// profiles, and so should be tried as an arduino
+//
+func (registry *deviceRegistry) known(dev *usbSerialDevice) bool {
+	if _, ok := registry.identify(dev); ok {
+		return true
+	}
+	_, ok := registry.profile(dev)
+	return ok
+}
+
+// profile returns the first profile matching the vendor and product IDs of a
+// USB serial device
+//
+func (registry *deviceRegistry) profile(dev *usbSerialDevice) (profile *serialProfile, ok bool) {
+	for _, profile := range registry.Profiles {
+		if !strings.EqualFold(profile.Vendor, dev.VendorID) {
+			continue
+		}
+		if len(profile.Product) == 0 || strings.EqualFold(profile.Product, dev.ProductID) {
+			return profile, true
+		}
+	}
+	return nil, false
+}
+
+// lookup returns the registry entry, if any, for the board found at the
+// device name by the last scan, along with the serial settings to be used
+// for the board
+//
+func (registry *deviceRegistry) lookup(devName string) (entry *registeredDevice, settings serialSettings) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	settings = defaultSerial
+
+	dev, ok := registry.byPath[devName]
+	if !ok {
+		return nil, settings
+	}
+	if profile, ok := registry.profile(&dev); ok {
+		settings = profile.serialSettings.over(settings)
+	}
+	if entry, ok = registry.identify(&dev); ok {
+		settings = entry.serialSettings.over(settings)
+	}
+	return entry, settings
+}
+
+// identity returns the key used to track the state of the device, which is
+// the USB serial number of the board found at the device name by the last
+// scan when it has one, or the device name
+//
+func (registry *deviceRegistry) identity(devName string) (key string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if dev, ok := registry.byPath[devName]; ok && len(dev.Serial) != 0 {
+		return dev.Serial
+	}
+	return devName
+}
+
+// scanned records the USB serial devices found by a scan, logging the
+// registered boards that have gone missing or have returned and returning
+// their serial numbers
+//
+func (registry *deviceRegistry) scanned(found []usbSerialDevice) (missing []string, returned []string) {
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.byPath = make(map[string]usbSerialDevice, len(found))
+
+	present := map[string]bool{}
+	for _, dev := range found {
+		registry.byPath[dev.Path] = dev
+		if len(dev.Serial) != 0 {
+			present[dev.Serial] = true
+		}
+	}
+
+	for _, entry := range registry.Devices {
+		switch {
+		case !present[entry.Serial] && !registry.missing[entry.Serial]:
+			registry.missing[entry.Serial] = true
+			missing = append(missing, entry.Serial)
+			logW.Warn(fmt.Sprintf("the arduino '%s' serial # '%s' for %s is missing", entry.Name, entry.Serial, entry.Portal))
+		case present[entry.Serial] && registry.missing[entry.Serial]:
+			delete(registry.missing, entry.Serial)
+			returned = append(returned, entry.Serial)
+			logW.Info(fmt.Sprintf("the arduino '%s' serial # '%s' for %s has been found", entry.Name, entry.Serial, entry.Portal))
+		}
+	}
+	return missing, returned
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRegistry writes the JSon to a registry file in the directory
+//
+func writeRegistry(t *testing.T, dir string, data string) (file string) {
+	file = filepath.Join(dir, "registry.json")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadRegistry(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "valid",
+			data: `{"devices": [{"serial": "1", "name": "north"}, {"serial": "2"}], "profiles": [{"vendor": "1a86", "product": "7523"}, {"vendor": "1a86", "product": "5523"}]}`,
+		},
+		{name: "not json", data: `{"devices": [`, err: "could not be decoded"},
+		{name: "no serial", data: `{"devices": [{"name": "north"}]}`, err: "device 1 in"},
+		{name: "null device", data: `{"devices": [null]}`, err: "has no serial number"},
+		{name: "duplicate serial", data: `{"devices": [{"serial": "1"}, {"serial": "1"}]}`, err: "serial number 1 appears more than once"},
+		{name: "duplicate name", data: `{"devices": [{"serial": "1", "name": "north"}, {"serial": "2", "name": "north"}]}`, err: "name 'north' appears more than once"},
+		// A board without a name is named after its serial number
+		{name: "name of serial", data: `{"devices": [{"serial": "1"}, {"serial": "2", "name": "1"}]}`, err: "name '1' appears more than once"},
+		{name: "bad settings", data: `{"devices": [{"serial": "1", "parity": "sideways"}]}`, err: "bad serial settings"},
+		{name: "profile without vendor", data: `{"profiles": [{"product": "7523"}]}`, err: "profile 1 in"},
+		{name: "bad profile", data: `{"profiles": [{"vendor": "1a86", "size": 9}]}`, err: "profile 1 in"},
+		{name: "hidden profile", data: `{"profiles": [{"vendor": "1a86"}, {"vendor": "1A86", "product": "7523"}]}`, err: "hidden by an earlier profile"},
+		{name: "repeated profile", data: `{"profiles": [{"vendor": "1a86", "product": "7523"}, {"vendor": "1a86", "product": "7523"}]}`, err: "profile 2 in"},
+	}
+
+	for _, test := range tests {
+		registry, err := loadRegistry(writeRegistry(t, dir, test.data))
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s: expected the registry to load, not %s", test.name, err.Error())
+		case len(test.err) != 0 && err == nil:
+			t.Errorf("%s: expected the error '%s'", test.name, test.err)
+		case len(test.err) != 0 && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: expected the error '%s', not '%s'", test.name, test.err, err.Error())
+		case err == nil && registry == nil:
+			t.Errorf("%s: expected a registry", test.name)
+		}
+	}
+
+	if registry, err := loadRegistry(""); err != nil || !registry.empty() {
+		t.Errorf("expected an empty registry without a file, not %v", err)
+	}
+	if _, err := loadRegistry(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected a missing registry file to fail")
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry, err := loadRegistry(writeRegistry(t, dir, `{
+		"profiles": [
+			{"vendor": "1a86", "product": "7523", "baud": 115200, "settleMs": 0, "startMs": 1000},
+			{"vendor": "2341", "parity": "even"}
+		],
+		"devices": [
+			{"serial": "85531303", "name": "north leds", "portal": "P", "baud": 57600, "stopBits": 2},
+			{"serial": "75439313", "name": "south leds", "portal": "P", "readTimeoutMs": 300}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry.scanned([]usbSerialDevice{
+		{Path: "/dev/ttyUSB0", VendorID: "1a86", ProductID: "7523", Serial: "85531303"},
+		{Path: "/dev/ttyACM0", VendorID: "2341", ProductID: "0043", Serial: "75439313"},
+		{Path: "/dev/ttyUSB1", VendorID: "1A86", ProductID: "7523"},
+		{Path: "/dev/ttyACM1", VendorID: "2341", ProductID: "0001", Serial: "11111111"},
+		{Path: "/dev/ttyUSB2", VendorID: "0403", ProductID: "6001", Serial: "22222222"},
+	})
+
+	// settings builds the expected settings from the defaults
+	settings := func(change func(s *serialSettings)) serialSettings {
+		s := defaultSerial
+		change(&s)
+		return s
+	}
+
+	tests := []struct {
+		devName  string
+		entry    string
+		key      string
+		known    bool
+		settings serialSettings
+	}{
+		{
+			// The entry takes precedence over the profile, which takes
+			// precedence over the defaults
+			devName: "/dev/ttyUSB0",
+			entry:   "north leds",
+			key:     "85531303",
+			known:   true,
+			settings: settings(func(s *serialSettings) {
+				s.Baud, s.StopBits, s.SettleMs, s.StartMs = 57600, 2, millis(0), millis(1000)
+			}),
+		},
+		{
+			devName: "/dev/ttyACM0",
+			entry:   "south leds",
+			key:     "75439313",
+			known:   true,
+			settings: settings(func(s *serialSettings) {
+				s.Parity, s.ReadTimeoutMs = "even", millis(300)
+			}),
+		},
+		{
+			devName: "/dev/ttyUSB1",
+			key:     "/dev/ttyUSB1",
+			known:   true,
+			settings: settings(func(s *serialSettings) {
+				s.Baud, s.SettleMs, s.StartMs = 115200, millis(0), millis(1000)
+			}),
+		},
+		{
+			devName:  "/dev/ttyACM1",
+			key:      "11111111",
+			known:    true,
+			settings: settings(func(s *serialSettings) { s.Parity = "even" }),
+		},
+		{devName: "/dev/ttyUSB2", key: "22222222", settings: defaultSerial},
+		{devName: "/dev/ttyUSB9", key: "/dev/ttyUSB9", settings: defaultSerial},
+	}
+
+	for _, test := range tests {
+		entry, settings := registry.lookup(test.devName)
+		name := ""
+		if entry != nil {
+			name = entry.Name
+		}
+		if name != test.entry {
+			t.Errorf("%s: expected the entry '%s', not '%s'", test.devName, test.entry, name)
+		}
+		if !reflect.DeepEqual(settings, test.settings) {
+			t.Errorf("%s: expected the settings %+v, not %+v", test.devName, test.settings, settings)
+		}
+		if key := registry.identity(test.devName); key != test.key {
+			t.Errorf("%s: expected the identity %s, not %s", test.devName, test.key, key)
+		}
+		if dev, ok := registry.byPath[test.devName]; ok && registry.known(&dev) != test.known {
+			t.Errorf("%s: expected known to be %v", test.devName, test.known)
+		}
+	}
+}
+
+func TestRegistryScanned(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry, err := loadRegistry(writeRegistry(t, dir, `{"devices": [{"serial": "1", "portal": "P"}, {"serial": "2", "portal": "P"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each scan lists the serial numbers found, a board is reported as
+	// missing once when it goes and as found once when it returns
+	tests := []struct {
+		found    []string
+		missing  []string
+		returned []string
+	}{
+		{found: []string{"1", "2"}},
+		{found: []string{"1"}, missing: []string{"2"}},
+		{found: []string{"1", "3"}},
+		{found: []string{}, missing: []string{"1"}},
+		{found: []string{"2"}, returned: []string{"2"}},
+		{found: []string{"1", "2"}, returned: []string{"1"}},
+		{found: []string{"2", "1"}},
+	}
+
+	for i, test := range tests {
+		found := []usbSerialDevice{}
+		for n, serial := range test.found {
+			found = append(found, usbSerialDevice{Path: fmt.Sprintf("/dev/ttyACM%d", n), Serial: serial})
+		}
+		missing, returned := registry.scanned(found)
+		if !reflect.DeepEqual(missing, test.missing) || !reflect.DeepEqual(returned, test.returned) {
+			t.Errorf("scan %d: expected %v to be missing and %v found, not %v and %v", i+1, test.missing, test.returned, missing, returned)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+// This module implements the rules that map portal events to the sounds
+// played and the lines sent to the arduinos.  Rules are read from a JSon file
+// given using the -rules option, or are the built in defaults when no file is
+// given.  The file is checked for changes as statuses arrive and is reloaded
+// when it changes, so that the behavior of the portal can be changed at the
+// event without restarting the gateway.  A file that fails to load is logged
+// and the previous rules are kept.
+//
+// A rules file looks like the following,
+//
+//   {
+//       "rules": [
+//           {"event": "faction-changed", "when": {"prevFaction": "Enlightened"}, "sfx": ["e-loss"]},
+//           {"event": "ambient", "when": {"faction": "Resistance"}, "ambient": "r-ambient"},
+//           {"event": "health-crossed", "when": {"healthBelow": 25}, "arduino": ["H{{percent .Event.Health}}"]}
+//       ]
+//   }
+//
+// The event is one of the portal event kinds, one of the events raised by the
+// arduinos, or ambient which is evaluated whenever the ambient track needs to
+// be chosen.  Every condition given in when must hold for the rule to apply,
+// the conditions being faction, prevFaction, position, owner, portal, input,
+// minLevel, maxLevel, threshold, healthBelow and healthAbove.  The levels are
+// those of the event or, when the event has no level, the portal.  Health is
+// the health of the portal.
+//
+// The sfx clips of every rule that applies are played in the order the rules
+// appear in the file, each clip being played once.  The arduino lines are
+// text/template templates given the Event and the Status, and are sent to the
+// arduinos of the portal after the regular status line.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	rulesFile = flag.String("rules", "", "A JSon file of rules mapping portal events to sounds and arduino lines, when not specified the built in rules are used")
+)
+
+// ambientNeeded is the kind of the pseudo event evaluated when the ambient
+// track for a portal is chosen
+const ambientNeeded = "ambient"
+
+// defaultRules reproduce the behavior of the gateway before rules could be
+// changed.  As sounds are played in the order of the rules these are listed so
+// that the changes in one status play as a sequence, the loss of the portal,
+// the resonators destroyed, the capture and then the resonators deployed.  The
+// sounds used are those shipped in assets/sounds apart from the ambient tracks
+const defaultRules = `{
+    "rules": [
+        {"event": "faction-changed", "when": {"prevFaction": "Neutral"}, "sfx": ["n-loss"]},
+        {"event": "faction-changed", "when": {"prevFaction": "Enlightened"}, "sfx": ["e-loss"]},
+        {"event": "faction-changed", "when": {"prevFaction": "Resistance"}, "sfx": ["r-loss"]},
+        {"event": "resonator-destroyed", "when": {"faction": "Enlightened"}, "sfx": ["e-resonator-destroyed"]},
+        {"event": "resonator-destroyed", "when": {"faction": "Resistance"}, "sfx": ["r-resonator-destroyed"]},
+        {"event": "faction-changed", "when": {"faction": "Neutral"}, "sfx": ["n-capture"]},
+        {"event": "faction-changed", "when": {"faction": "Enlightened"}, "sfx": ["e-capture"]},
+        {"event": "faction-changed", "when": {"faction": "Resistance"}, "sfx": ["r-capture"]},
+        {"event": "resonator-deployed", "when": {"faction": "Enlightened"}, "sfx": ["e-resonator-deployed"]},
+        {"event": "resonator-deployed", "when": {"faction": "Resistance"}, "sfx": ["r-resonator-deployed"]},
+        {"event": "ambient", "when": {"faction": "Neutral"}, "ambient": "n-ambient"},
+        {"event": "ambient", "when": {"faction": "Enlightened"}, "ambient": "e-ambient"},
+        {"event": "ambient", "when": {"faction": "Resistance"}, "ambient": "r-ambient"}
+    ]
+}`
+
+type ruleCondition struct {
+	Faction     string   `json:"faction"`
+	PrevFaction string   `json:"prevFaction"`
+	Position    string   `json:"position"`
+	Owner       string   `json:"owner"`
+	Portal      string   `json:"portal"`
+	Input       string   `json:"input"`
+	MinLevel    int      `json:"minLevel"`
+	MaxLevel    int      `json:"maxLevel"`
+	Threshold   float32  `json:"threshold"`
+	HealthBelow *float32 `json:"healthBelow"`
+	HealthAbove *float32 `json:"healthAbove"`
+}
+
+type rule struct {
+	Event   string        `json:"event"`
+	When    ruleCondition `json:"when"`
+	Sfx     []string      `json:"sfx"`
+	Ambient string        `json:"ambient"`
+	Arduino []string      `json:"arduino"`
+
+	arduino []*template.Template
+}
+
+type ruleSet struct {
+	Rules []*rule `json:"rules"`
+}
+
+// ruleActions are the actions gathered from the rules applying to the events
+// from a single portal status
+//
+type ruleActions struct {
+	sfxs    []string
+	ambient string
+	lines   [][]byte
+}
+
+var ruleKinds = map[string]bool{
+	factionChanged:      true,
+	resonatorDeployed:   true,
+	resonatorDestroyed:  true,
+	resonatorUpgraded:   true,
+	resonatorDowngraded: true,
+	modAdded:            true,
+	modRemoved:          true,
+	ownerChanged:        true,
+	levelChanged:        true,
+	healthCrossed:       true,
+	buttonPressed:       true,
+	sensorReading:       true,
+	ambientNeeded:       true,
+}
+
+var ruleFuncs = template.FuncMap{
+	"percent": func(v float32) string { return string(encodePercent(int(v))) },
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+}
+
+// parseRules decodes and checks a set of rules, compiling the templates for
+// the arduino lines
+//
+func parseRules(name string, data []byte) (rules *ruleSet, err error) {
+
+	rules = &ruleSet{}
+	if err = json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("rules %s could not be decoded due to %s", name, err.Error())
+	}
+
+	for i, r := range rules.Rules {
+		if r == nil || !ruleKinds[r.Event] {
+			return nil, fmt.Errorf("rule %d in %s has an unknown event", i+1, name)
+		}
+		for j, line := range r.Arduino {
+			tmpl, err := template.New(fmt.Sprintf("%s rule %d line %d", name, i+1, j+1)).Funcs(ruleFuncs).Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d in %s has a bad arduino line due to %s", i+1, name, err.Error())
+			}
+			r.arduino = append(r.arduino, tmpl)
+		}
+	}
+	return rules, nil
+}
+
+// matches tests the conditions of the rule against an event and the status
+// from which the event was derived
+//
+func (r *rule) matches(ev *portalEvent, state *portalStatus) bool {
+
+	if r.Event != ev.Kind {
+		return false
+	}
+
+	when := &r.When
+	if len(when.Faction) != 0 && when.Faction != ev.Faction {
+		return false
+	}
+	if len(when.PrevFaction) != 0 && when.PrevFaction != ev.PrevFaction {
+		return false
+	}
+	if len(when.Position) != 0 && when.Position != ev.Position {
+		return false
+	}
+	if len(when.Owner) != 0 && when.Owner != ev.Owner {
+		return false
+	}
+	if len(when.Portal) != 0 && when.Portal != ev.Portal {
+		return false
+	}
+	if len(when.Input) != 0 && when.Input != ev.Input {
+		return false
+	}
+
+	level := ev.Level
+	if level == 0 {
+		level = int(state.Status.Level)
+	}
+	if when.MinLevel != 0 && level < when.MinLevel {
+		return false
+	}
+	if when.MaxLevel != 0 && level > when.MaxLevel {
+		return false
+	}
+
+	if when.Threshold != 0 && when.Threshold != ev.Threshold {
+		return false
+	}
+	if when.HealthBelow != nil && !(state.Status.Health < *when.HealthBelow) {
+		return false
+	}
+	if when.HealthAbove != nil && !(state.Status.Health > *when.HealthAbove) {
+		return false
+	}
+	return true
+}
+
+// apply gathers the actions of the rules that apply to the events
+//
+func (rules *ruleSet) apply(events []portalEvent, state *portalStatus) (actions *ruleActions) {
+
+	actions = &ruleActions{
+		sfxs:  []string{},
+		lines: [][]byte{},
+	}
+	played := map[string]bool{}
+
+	// Rules are visited in the order they appear so that the rules
+	// decide the sequence in which the sounds are played
+	for _, r := range rules.Rules {
+		for i := range events {
+			ev := &events[i]
+			if !r.matches(ev, state) {
+				continue
+			}
+
+			for _, sfx := range r.Sfx {
+				if !played[sfx] {
+					played[sfx] = true
+					actions.sfxs = append(actions.sfxs, sfx)
+				}
+			}
+			if len(r.Ambient) != 0 {
+				actions.ambient = r.Ambient
+			}
+
+			for _, tmpl := range r.arduino {
+				line := &bytes.Buffer{}
+				data := struct {
+					Event  *portalEvent
+					Status *portalStatus
+				}{
+					Event:  ev,
+					Status: state,
+				}
+				if err := tmpl.Execute(line, data); err != nil {
+					logW.Warn(fmt.Sprintf("%s could not be generated due to %s", tmpl.Name(), err.Error()))
+					continue
+				}
+				if !bytes.HasSuffix(line.Bytes(), []byte{'\n'}) {
+					line.WriteByte('\n')
+				}
+				actions.lines = append(actions.lines, line.Bytes())
+			}
+		}
+	}
+	return actions
+}
+
+// ruleBook holds the rules currently in use, reloading them from the rules
+// file when it is modified
+//
+type ruleBook struct {
+	file     string
+	modified time.Time
+	rules    *ruleSet
+	sync.Mutex
+}
+
+func newRuleBook(file string) (book *ruleBook, err error) {
+
+	book = &ruleBook{
+		file: file,
+	}
+
+	if len(file) == 0 {
+		if book.rules, err = parseRules("built in rules", []byte(defaultRules)); err != nil {
+			return nil, err
+		}
+		return book, nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = book.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+func (book *ruleBook) load(modified time.Time) (err error) {
+
+	data, err := ioutil.ReadFile(book.file)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(book.file, data)
+	if err != nil {
+		return err
+	}
+
+	book.rules = rules
+	book.modified = modified
+	logW.Info(fmt.Sprintf("loaded %d rules from %s", len(rules.Rules), book.file))
+	return nil
+}
+
+// current returns the rules in use, first reloading the rules file if it has
+// changed since it was last loaded
+//
+func (book *ruleBook) current() (rules *ruleSet) {
+
+	book.Lock()
+	defer book.Unlock()
+
+	if len(book.file) != 0 {
+		if info, err := os.Stat(book.file); err == nil && !info.ModTime().Equal(book.modified) {
+			if err = book.load(info.ModTime()); err != nil {
+				// Remember the broken file so that it is only
+				// reported once
+				book.modified = info.ModTime()
+				logW.Warn(fmt.Sprintf("rules %s could not be reloaded due to %s, keeping the previous rules", book.file, err.Error()))
+			}
+		}
+	}
+	return book.rules
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefaultRulesSequence(t *testing.T) {
+
+	book, err := newRuleBook("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := &portalStatus{Status: status{
+		Title:              "P",
+		ControllingFaction: "Enlightened",
+		Resonators: []resonator{
+			{Position: "N", Level: 3, Owner: "alice"},
+			{Position: "E", Level: 4, Owner: "alice"},
+		},
+	}}
+	cur := &portalStatus{Status: status{
+		Title:              "P",
+		ControllingFaction: "Resistance",
+		Resonators: []resonator{
+			{Position: "N", Level: 5, Owner: "bob"},
+			{Position: "S", Level: 5, Owner: "bob"},
+		},
+	}}
+
+	// Several resonators changing in one status play each clip once, in
+	// the sequence loss, destroyed, capture and deployed
+	actions := book.current().apply(diffPortal(prev, cur, nil), cur)
+	expected := []string{"e-loss", "e-resonator-destroyed", "r-capture", "r-resonator-deployed"}
+	if !reflect.DeepEqual(actions.sfxs, expected) {
+		t.Fatalf("expected the sounds %q, not %q", expected, actions.sfxs)
+	}
+}
+
+func TestDefaultRulesAssets(t *testing.T) {
+
+	rules, err := parseRules("built in rules", []byte(defaultRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range rules.Rules {
+		for _, sfx := range r.Sfx {
+			if _, err := os.Stat(filepath.Join("assets", "sounds", sfx+".aiff")); err != nil {
+				t.Errorf("the built in rules play %s which is not in assets/sounds", sfx)
+			}
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+
+	bad := map[string]string{
+		"json":     `{"rules": [`,
+		"event":    `{"rules": [{"event": "portal-exploded"}]}`,
+		"missing":  `{"rules": [null]}`,
+		"template": `{"rules": [{"event": "level-changed", "arduino": ["L{{.Event.Level"]}]}`,
+	}
+	for name, data := range bad {
+		if _, err := parseRules(name, []byte(data)); err == nil {
+			t.Errorf("%s: expected the rules to be rejected", name)
+		}
+	}
+
+	rules, err := parseRules("good", []byte(`{"rules": [{"event": "level-changed", "arduino": ["L{{.Event.Level}}", "P{{lower .Status.Status.Title}}"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Rules) != 1 || len(rules.Rules[0].arduino) != 2 {
+		t.Fatalf("expected one rule with two arduino lines, not %d rules", len(rules.Rules))
+	}
+}
+
+func TestRulesApply(t *testing.T) {
+
+	rules, err := parseRules("test", []byte(`{
+    "rules": [
+        {"event": "resonator-deployed", "when": {"position": "N", "minLevel": 7}, "sfx": ["big"]},
+        {"event": "resonator-deployed", "when": {"owner": "bob"}, "sfx": ["bob", "big"]},
+        {"event": "health-crossed", "when": {"threshold": 25, "healthBelow": 25}, "arduino": ["H{{percent .Event.Health}}"]},
+        {"event": "level-changed", "when": {"maxLevel": 4}, "arduino": ["L{{.Event.Level}} {{lower .Status.Status.ControllingFaction}}\n"]},
+        {"event": "ambient", "when": {"portal": "P", "faction": "Resistance"}, "ambient": "r-ambient"}
+    ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &portalStatus{Status: status{Title: "P", ControllingFaction: "Resistance", Level: 3, Health: 20}}
+
+	tests := []struct {
+		name    string
+		events  []portalEvent
+		sfxs    []string
+		ambient string
+		lines   []string
+	}{
+		{
+			name: "levels",
+			events: []portalEvent{
+				{Kind: resonatorDeployed, Position: "N", Level: 6, Owner: "alice"},
+				{Kind: resonatorDeployed, Position: "N", Level: 8, Owner: "alice"},
+			},
+			sfxs: []string{"big"},
+		},
+		{
+			// Each sound is played once, in the order of the rules
+			name: "once",
+			events: []portalEvent{
+				{Kind: resonatorDeployed, Position: "E", Level: 3, Owner: "bob"},
+				{Kind: resonatorDeployed, Position: "N", Level: 8, Owner: "alice"},
+			},
+			sfxs: []string{"big", "bob"},
+		},
+		{
+			name: "health",
+			events: []portalEvent{
+				{Kind: healthCrossed, Health: 20, Threshold: 50},
+				{Kind: healthCrossed, Health: 20, Threshold: 25},
+			},
+			sfxs:  []string{},
+			lines: []string{"H" + string(encodePercent(20)) + "\n"},
+		},
+		{
+			name:   "level",
+			events: []portalEvent{{Kind: levelChanged, Level: 3, PrevLevel: 5}, {Kind: ownerChanged}},
+			sfxs:   []string{},
+			lines:  []string{"L3 resistance\n"},
+		},
+		{
+			name:    "ambient",
+			events:  []portalEvent{{Kind: ambientNeeded, Portal: "P", Faction: "Resistance"}},
+			sfxs:    []string{},
+			ambient: "r-ambient",
+		},
+	}
+
+	for _, test := range tests {
+		actions := rules.apply(test.events, state)
+
+		lines := []string{}
+		for _, line := range actions.lines {
+			lines = append(lines, string(line))
+		}
+		if test.lines == nil {
+			test.lines = []string{}
+		}
+
+		if !reflect.DeepEqual(actions.sfxs, test.sfxs) || actions.ambient != test.ambient || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected %q, '%s' and %q, not %q, '%s' and %q", test.name,
+				test.sfxs, test.ambient, test.lines, actions.sfxs, actions.ambient, lines)
+		}
+	}
+}
+
+func TestRuleBookReload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rules.json")
+	if err = ioutil.WriteFile(file, []byte(`{"rules": [{"event": "ambient", "ambient": "first"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	book, err := newRuleBook(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ambient := func() string {
+		return book.current().apply([]portalEvent{{Kind: ambientNeeded}}, &portalStatus{}).ambient
+	}
+	if track := ambient(); track != "first" {
+		t.Fatalf("expected the ambient track first, not '%s'", track)
+	}
+
+	// A change is picked up, a broken file is ignored
+	update := func(data string, modified time.Time) {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(`{"rules": [{"event": "ambient", "ambient": "second"}]}`, time.Now().Add(time.Minute))
+	if track := ambient(); track != "second" {
+		t.Fatalf("expected the reloaded ambient track second, not '%s'", track)
+	}
+	update(`{"rules": [{"event": "bogus"}]}`, time.Now().Add(2*time.Minute))
+	if track := ambient(); track != "second" {
+		t.Fatalf("expected the previous rules to be kept, not '%s'", track)
+	}
+}
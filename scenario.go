@@ -0,0 +1,192 @@
+package main
+
+// This module implements a source of portal status that plays back the test
+// scenarios found in the simulator/scenarios directory without needing a web
+// server such as HttpRoller.  Scenarios are directories containing numbered
+// directories, the number being the offset in seconds from the start of the
+// scenario at which the tecthulhu status found in the <offset>/module/status/json
+// file takes effect.  An empty <offset>/finish file marks the end of the scenario.
+//
+// URIs take the form scenario://simulator/scenarios/XM_drain_all?loop=true&speed=4
+// for scenarios relative to the working directory, or scenario:///path/to/scenario
+// for absolute paths.  When loop is true the scenario restarts once finished,
+// otherwise the final status continues to be reported.  The speed multiplier
+// allows scenarios to be run more quickly than real time.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type scenarioStep struct {
+	offset time.Duration
+	status *portalStatus
+}
+
+type scenarioSteps []scenarioStep
+
+func (steps scenarioSteps) Len() int           { return len(steps) }
+func (steps scenarioSteps) Swap(i, j int)      { steps[i], steps[j] = steps[j], steps[i] }
+func (steps scenarioSteps) Less(i, j int) bool { return steps[i].offset < steps[j].offset }
+
+type scenario struct {
+	url     string
+	statusC chan *portalStatus
+	errorC  chan error
+}
+
+// scenarioDir extracts the directory of a scenario from its URI
+//
+func scenarioDir(scenURL *url.URL) (dir string) {
+	return filepath.FromSlash(scenURL.Host + scenURL.Path)
+}
+
+// loadScenario reads all of the statuses in a scenario directory, returning
+// them in the order they are to be played along with the length of the
+// scenario
+//
+func loadScenario(dir string) (steps scenarioSteps, finish time.Duration, err error) {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	steps = scenarioSteps{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		seconds, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		offset := time.Duration(seconds) * time.Second
+
+		if _, err = os.Stat(filepath.Join(dir, entry.Name(), "finish")); err == nil && offset > finish {
+			finish = offset
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), "module", "status", "json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+		status, err := decodeTecthulhu(body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scenario step %s could not be parsed due to %s", filepath.Join(dir, entry.Name()), err.Error())
+		}
+		if unknown := checkMods(status); len(unknown) != 0 {
+			return nil, 0, fmt.Errorf("scenario step %s has mods that are not in the catalog %v", filepath.Join(dir, entry.Name()), unknown)
+		}
+		steps = append(steps, scenarioStep{offset: offset, status: status})
+	}
+
+	if len(steps) == 0 {
+		return nil, 0, fmt.Errorf("scenario %s contains no statuses", dir)
+	}
+
+	sort.Sort(steps)
+
+	if finish <= steps[len(steps)-1].offset {
+		finish = steps[len(steps)-1].offset + time.Second
+	}
+	return steps, finish, nil
+}
+
+// startPortals plays the scenario, reporting each status as it takes effect
+// and repeating the current status at the poll interval as a tecthulhu
+// being polled would
+//
+func (scen *scenario) startPortals(quitC chan bool) (err error) {
+
+	scenURL, err := url.Parse(scen.url)
+	if err != nil {
+		publishError(fmt.Errorf("scenario %s could not be used due to %s", scen.url, err.Error()), scen.errorC)
+		return err
+	}
+
+	query := scenURL.Query()
+	loop := query.Get("loop") == "true"
+	speed := 1.0
+	if speedStr := query.Get("speed"); len(speedStr) != 0 {
+		if speed, err = strconv.ParseFloat(speedStr, 64); err != nil || speed <= 0 {
+			err = fmt.Errorf("scenario %s has an invalid speed '%s'", scen.url, speedStr)
+			publishError(err, scen.errorC)
+			return err
+		}
+	}
+
+	steps, finish, err := loadScenario(scenarioDir(scenURL))
+	if err != nil {
+		publishError(fmt.Errorf("scenario %s could not be loaded due to %s", scen.url, err.Error()), scen.errorC)
+		return err
+	}
+
+	logW.Info(fmt.Sprintf("playing scenario %s, %d statuses over %s", scen.url, len(steps), finish.String()))
+
+	// scaled converts a period of time within the scenario into real time
+	scaled := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) / speed)
+	}
+
+	start := time.Now()
+	current := -1
+	published := time.Time{}
+
+	for {
+		elapsed := time.Duration(float64(time.Since(start)) * speed)
+
+		if elapsed >= finish && loop {
+			start = start.Add(scaled(finish))
+			current = -1
+			logW.Debug(fmt.Sprintf("restarting scenario %s", scen.url))
+			continue
+		}
+
+		// Locate the status in effect at this point in the scenario
+		step := -1
+		for i := range steps {
+			if steps[i].offset > elapsed {
+				break
+			}
+			step = i
+		}
+
+		if step != -1 && (step != current || time.Since(published) >= *pollInterval) {
+			current = step
+			published = time.Now()
+			// Each step is repeated until the next one is due, the gateway
+			// is given its own copy each time
+			publishStatus(scen.url, steps[step].status.copy(), scen.statusC, scen.errorC)
+		}
+
+		// Wake up for the next status, or the poll interval, which ever
+		// comes first
+		wait := *pollInterval
+		if step+1 < len(steps) {
+			if next := scaled(steps[step+1].offset - elapsed); next < wait {
+				wait = next
+			}
+		} else if loop {
+			if next := scaled(finish - elapsed); next < wait {
+				wait = next
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-quitC:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScenarioRepeats(t *testing.T) {
+
+	defer setPollInterval(20 * time.Millisecond)()
+
+	uri := "scenario://simulator/scenarios/stable"
+	statusC, _, stop := streamSource(t, uri)
+	defer stop()
+
+	// The single status in the scenario is repeated at the poll interval,
+	// each repeat must be independent of the others
+	received := []*portalStatus{}
+	for len(received) < 2 {
+		select {
+		case status := <-statusC:
+			received = append(received, status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the scenario")
+		}
+	}
+
+	first, second := received[0], received[1]
+	if first == second {
+		t.Fatal("the same status was published twice")
+	}
+	if len(first.Status.Resonators) == 0 || len(second.Status.Resonators) != len(first.Status.Resonators) {
+		t.Fatalf("expected the resonators to be repeated, not %d and %d", len(first.Status.Resonators), len(second.Status.Resonators))
+	}
+
+	first.Status.Resonators[0].Health = -1
+	if second.Status.Resonators[0].Health == -1 {
+		t.Fatal("the repeated statuses share their resonators")
+	}
+}
+
+func TestScenarios(t *testing.T) {
+
+	root := filepath.Join("simulator", "scenarios")
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every scenario must load, which includes checking its mods against
+	// the catalog, and at least one must have mods for the check to mean
+	// anything
+	mods := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		steps, _, err := loadScenario(filepath.Join(root, entry.Name()))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, step := range steps {
+			mods += len(step.status.Status.Mods)
+		}
+	}
+	if mods == 0 {
+		t.Errorf("none of the scenarios in %s have mods", root)
+	}
+}
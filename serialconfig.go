@@ -0,0 +1,187 @@
+package main
+
+// This module implements the serial settings used to open each arduino.  The
+// settings are taken from the defaults, which suit the arduinos that reset when
+// they are opened, then from the first profile in the device registry that
+// matches the USB vendor and product IDs of the board, and lastly from the
+// registry entry for the board itself.  For example,
+//
+//   {
+//       "profiles": [
+//           {"vendor": "1a86", "product": "7523", "baud": 115200, "settleMs": 0, "startMs": 1000}
+//       ],
+//       "devices": [
+//           {"serial": "85531303", "name": "north leds", "autoBaud": [115200, 57600, 9600]}
+//       ]
+//   }
+//
+// The settings are,
+//
+//   baud           the baud rate, 9600 by default
+//   size           the number of data bits, 8 by default
+//   parity         none, odd, even, mark or space, none by default
+//   stopBits       1, 1.5 or 2, 1 by default
+//   readTimeoutMs  the time allowed for a reply to a ping before it is repeated
+//   settleMs       a delay after opening the port before the first ping
+//   startMs        the time allowed for the board to reply to the pings
+//   autoBaud       baud rates that are tried in turn until the board replies
+//                  to the pings with its role
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// serialSettings are the serial parameters for a device, zero values are
+// left to be filled in by the less specific settings
+//
+type serialSettings struct {
+	Baud          int     `json:"baud,omitempty"`
+	Size          int     `json:"size,omitempty"`
+	Parity        string  `json:"parity,omitempty"`
+	StopBits      float64 `json:"stopBits,omitempty"`
+	ReadTimeoutMs *int    `json:"readTimeoutMs,omitempty"`
+	SettleMs      *int    `json:"settleMs,omitempty"`
+	StartMs       *int    `json:"startMs,omitempty"`
+	AutoBaud      []int   `json:"autoBaud,omitempty"`
+}
+
+// serialProfile applies settings to every board with a USB vendor ID, and
+// optionally product ID
+//
+type serialProfile struct {
+	Vendor  string `json:"vendor"`
+	Product string `json:"product"`
+	serialSettings
+}
+
+func millis(ms int) *int {
+	return &ms
+}
+
+// defaultSerial suits the arduinos that reset when opened, these are pinged
+// until they have started
+var defaultSerial = serialSettings{
+	Baud:          9600,
+	Size:          8,
+	Parity:        "none",
+	StopBits:      1,
+	ReadTimeoutMs: millis(int(pingInterval / time.Millisecond)),
+	SettleMs:      millis(0),
+	StartMs:       millis(int(pingLimit / time.Millisecond)),
+}
+
+// over returns the settings with the values that have not been given taken
+// from the less specific settings
+//
+func (settings serialSettings) over(less serialSettings) (merged serialSettings) {
+	merged = settings
+	if merged.Baud == 0 {
+		merged.Baud = less.Baud
+	}
+	if merged.Size == 0 {
+		merged.Size = less.Size
+	}
+	if len(merged.Parity) == 0 {
+		merged.Parity = less.Parity
+	}
+	if merged.StopBits == 0 {
+		merged.StopBits = less.StopBits
+	}
+	if merged.ReadTimeoutMs == nil {
+		merged.ReadTimeoutMs = less.ReadTimeoutMs
+	}
+	if merged.SettleMs == nil {
+		merged.SettleMs = less.SettleMs
+	}
+	if merged.StartMs == nil {
+		merged.StartMs = less.StartMs
+	}
+	if len(merged.AutoBaud) == 0 {
+		merged.AutoBaud = less.AutoBaud
+	}
+	return merged
+}
+
+var parities = map[string]serial.Parity{
+	"none":  serial.ParityNone,
+	"odd":   serial.ParityOdd,
+	"even":  serial.ParityEven,
+	"mark":  serial.ParityMark,
+	"space": serial.ParitySpace,
+}
+
+var stopBits = map[float64]serial.StopBits{
+	1:   serial.Stop1,
+	1.5: serial.Stop1Half,
+	2:   serial.Stop2,
+}
+
+// check tests the settings that have been given for values that cannot be
+// used to open a port
+//
+func (settings serialSettings) check() (err error) {
+	if settings.Baud < 0 {
+		return fmt.Errorf("the baud rate %d is not valid", settings.Baud)
+	}
+	for _, baud := range settings.AutoBaud {
+		if baud <= 0 {
+			return fmt.Errorf("the auto baud rate %d is not valid", baud)
+		}
+	}
+	if settings.Size != 0 && (settings.Size < 5 || settings.Size > 8) {
+		return fmt.Errorf("%d data bits are not supported", settings.Size)
+	}
+	if _, ok := parities[strings.ToLower(settings.Parity)]; len(settings.Parity) != 0 && !ok {
+		return fmt.Errorf("the parity '%s' is not one of none, odd, even, mark or space", settings.Parity)
+	}
+	if _, ok := stopBits[settings.StopBits]; settings.StopBits != 0 && !ok {
+		return fmt.Errorf("%g stop bits are not supported", settings.StopBits)
+	}
+	if settings.ReadTimeoutMs != nil && *settings.ReadTimeoutMs < 100 {
+		return fmt.Errorf("the read timeout %dms is less than 100ms", *settings.ReadTimeoutMs)
+	}
+	for _, ms := range []*int{settings.SettleMs, settings.StartMs} {
+		if ms != nil && *ms < 0 {
+			return fmt.Errorf("the time %dms is not valid", *ms)
+		}
+	}
+	return nil
+}
+
+// config returns the configuration used to open the device at the baud rate
+//
+func (settings serialSettings) config(devName string, baud int) (config *serial.Config) {
+	return &serial.Config{
+		Name:        devName,
+		Baud:        baud,
+		ReadTimeout: settings.readTimeout(),
+		Size:        byte(settings.Size),
+		Parity:      parities[strings.ToLower(settings.Parity)],
+		StopBits:    stopBits[settings.StopBits],
+	}
+}
+
+// bauds returns the baud rates to be tried in turn
+//
+func (settings serialSettings) bauds() (rates []int) {
+	if len(settings.AutoBaud) != 0 {
+		return settings.AutoBaud
+	}
+	return []int{settings.Baud}
+}
+
+func (settings serialSettings) readTimeout() time.Duration {
+	return time.Duration(*settings.ReadTimeoutMs) * time.Millisecond
+}
+
+func (settings serialSettings) settle() time.Duration {
+	return time.Duration(*settings.SettleMs) * time.Millisecond
+}
+
+func (settings serialSettings) start() time.Duration {
+	return time.Duration(*settings.StartMs) * time.Millisecond
+}
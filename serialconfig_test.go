@@ -0,0 +1,240 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+func TestSerialOver(t *testing.T) {
+
+	less := serialSettings{
+		Baud:          9600,
+		Size:          8,
+		Parity:        "none",
+		StopBits:      1,
+		ReadTimeoutMs: millis(500),
+		SettleMs:      millis(2000),
+		StartMs:       millis(5000),
+		AutoBaud:      []int{9600, 57600},
+	}
+
+	// Each field given overrides the less specific settings on its own
+	tests := []struct {
+		name   string
+		more   serialSettings
+		change func(s *serialSettings)
+	}{
+		{"nothing", serialSettings{}, func(s *serialSettings) {}},
+		{"baud", serialSettings{Baud: 115200}, func(s *serialSettings) { s.Baud = 115200 }},
+		{"size", serialSettings{Size: 7}, func(s *serialSettings) { s.Size = 7 }},
+		{"parity", serialSettings{Parity: "even"}, func(s *serialSettings) { s.Parity = "even" }},
+		{"stop bits", serialSettings{StopBits: 2}, func(s *serialSettings) { s.StopBits = 2 }},
+		{"read timeout", serialSettings{ReadTimeoutMs: millis(300)}, func(s *serialSettings) { s.ReadTimeoutMs = millis(300) }},
+		// Zero is a valid settle and start time, which is why these are
+		// pointers
+		{"settle", serialSettings{SettleMs: millis(0)}, func(s *serialSettings) { s.SettleMs = millis(0) }},
+		{"start", serialSettings{StartMs: millis(0)}, func(s *serialSettings) { s.StartMs = millis(0) }},
+		{"auto baud", serialSettings{AutoBaud: []int{115200}}, func(s *serialSettings) { s.AutoBaud = []int{115200} }},
+	}
+
+	for _, test := range tests {
+		expected := less
+		test.change(&expected)
+		if merged := test.more.over(less); !reflect.DeepEqual(merged, expected) {
+			t.Errorf("%s: expected %+v, not %+v", test.name, expected, merged)
+		}
+	}
+}
+
+func TestSerialSettings(t *testing.T) {
+
+	settings := serialSettings{
+		Baud:          115200,
+		Size:          7,
+		Parity:        "Even",
+		StopBits:      1.5,
+		ReadTimeoutMs: millis(300),
+		SettleMs:      millis(250),
+		StartMs:       millis(1000),
+	}.over(defaultSerial)
+
+	if settings.readTimeout() != 300*time.Millisecond || settings.settle() != 250*time.Millisecond || settings.start() != time.Second {
+		t.Errorf("expected times of 300ms, 250ms and 1s, not %s, %s and %s", settings.readTimeout(), settings.settle(), settings.start())
+	}
+
+	expected := &serial.Config{
+		Name:        "/dev/ttyUSB0",
+		Baud:        57600,
+		ReadTimeout: 300 * time.Millisecond,
+		Size:        7,
+		Parity:      serial.ParityEven,
+		StopBits:    serial.Stop1Half,
+	}
+	if config := settings.config("/dev/ttyUSB0", 57600); !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected the configuration %+v, not %+v", expected, config)
+	}
+
+	// The defaults suit the arduinos that reset when they are opened
+	expected = &serial.Config{
+		Name:        "/dev/ttyACM0",
+		Baud:        9600,
+		ReadTimeout: pingInterval,
+		Size:        8,
+		Parity:      serial.ParityNone,
+		StopBits:    serial.Stop1,
+	}
+	if config := defaultSerial.config("/dev/ttyACM0", defaultSerial.Baud); !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected the default configuration %+v, not %+v", expected, config)
+	}
+	if defaultSerial.start() != pingLimit || defaultSerial.settle() != 0 {
+		t.Errorf("expected the default start of %s without settling, not %s and %s", pingLimit, defaultSerial.start(), defaultSerial.settle())
+	}
+}
+
+func TestSerialBauds(t *testing.T) {
+
+	profile := serialSettings{Baud: 57600, AutoBaud: []int{115200, 57600}}
+
+	tests := []struct {
+		name     string
+		settings serialSettings
+		bauds    []int
+	}{
+		{"defaults", defaultSerial, []int{9600}},
+		{"baud", serialSettings{Baud: 115200}.over(defaultSerial), []int{115200}},
+		{"auto baud", serialSettings{AutoBaud: []int{115200, 9600}}.over(defaultSerial), []int{115200, 9600}},
+		// The auto baud rates of a profile are used unless the entry
+		// gives its own
+		{"profile", serialSettings{Baud: 9600}.over(profile.over(defaultSerial)), []int{115200, 57600}},
+		{"entry", serialSettings{AutoBaud: []int{19200}}.over(profile.over(defaultSerial)), []int{19200}},
+	}
+
+	for _, test := range tests {
+		if bauds := test.settings.bauds(); !reflect.DeepEqual(bauds, test.bauds) {
+			t.Errorf("%s: expected the baud rates %v, not %v", test.name, test.bauds, bauds)
+		}
+	}
+}
+
+func TestSerialCheck(t *testing.T) {
+
+	tests := []struct {
+		settings serialSettings
+		err      string
+	}{
+		{serialSettings{}, ""},
+		{defaultSerial, ""},
+		{serialSettings{Baud: 115200, Size: 5, Parity: "SPACE", StopBits: 2, SettleMs: millis(0), StartMs: millis(0)}, ""},
+		{serialSettings{Baud: -1}, "baud rate -1"},
+		{serialSettings{AutoBaud: []int{9600, 0}}, "auto baud rate 0"},
+		{serialSettings{Size: 9}, "9 data bits"},
+		{serialSettings{Size: 4}, "4 data bits"},
+		{serialSettings{Parity: "sideways"}, "parity 'sideways'"},
+		{serialSettings{StopBits: 3}, "3 stop bits"},
+		{serialSettings{ReadTimeoutMs: millis(50)}, "read timeout 50ms"},
+		{serialSettings{SettleMs: millis(-1)}, "time -1ms"},
+		{serialSettings{StartMs: millis(-5)}, "time -5ms"},
+	}
+
+	for _, test := range tests {
+		err := test.settings.check()
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%+v: expected the settings to be accepted, not %s", test.settings, err.Error())
+		case len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%+v: expected the error '%s', not %v", test.settings, test.err, err)
+		}
+	}
+}
+
+func TestIsRole(t *testing.T) {
+
+	tests := []struct {
+		reply string
+		role  bool
+	}{
+		{"Magnus Core Node", true},
+		{"Magnus Resonators Node v2", true},
+		{"", false},
+		{"\x01\xfe\x83", false},
+		{"Magnus\x00Core", false},
+		{"Magnus\tCore", false},
+		{"café", false},
+	}
+
+	for _, test := range tests {
+		if role := isRole(test.reply); role != test.role {
+			t.Errorf("%q: expected %v, not %v", test.reply, test.role, role)
+		}
+	}
+}
+
+// answerPings replies to each ping written to the pty with the next of the
+// replies, until told to stop.  The device reopens the pty at each baud rate,
+// between which reading the master fails
+//
+func answerPings(master *os.File, replies []string, stopC chan bool) {
+	buf := make([]byte, 256)
+	for {
+		select {
+		case <-stopC:
+			return
+		default:
+		}
+		n, err := master.Read(buf)
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if n == 0 || buf[0] != '*' || len(replies) == 0 {
+			continue
+		}
+		master.Write([]byte(replies[0] + "\n"))
+		if len(replies) > 1 {
+			replies = replies[1:]
+		}
+	}
+}
+
+func TestAutoBaud(t *testing.T) {
+
+	settings := serialSettings{AutoBaud: []int{115200, 57600, 9600}, StartMs: millis(1000)}.over(defaultSerial)
+
+	tests := []struct {
+		name    string
+		replies []string
+		role    string
+	}{
+		// Noise is received until the rate the board uses is tried
+		{"noise", []string{"\x01\xfe\x83", "\x80\x80", "Magnus Core Node"}, "Magnus Core Node"},
+		{"first", []string{"Magnus Resonators Node"}, "Magnus Resonators Node"},
+		{"never", []string{"\xff\xfe"}, ""},
+	}
+
+	for _, test := range tests {
+		master, name := openPty(t)
+		stopC := make(chan bool)
+		go answerPings(master, test.replies, stopC)
+
+		dev, err := startDevice("P", name, name, nil, settings)
+		switch {
+		case len(test.role) == 0 && err == nil:
+			t.Errorf("%s: expected the board not to reply at any rate, not the role '%s'", test.name, dev.role)
+		case len(test.role) != 0 && err != nil:
+			t.Errorf("%s: expected the role '%s', not %s", test.name, test.role, err.Error())
+		case len(test.role) != 0 && dev.role != test.role:
+			t.Errorf("%s: expected the role '%s', not '%s'", test.name, test.role, dev.role)
+		}
+		if dev != nil {
+			dev.close()
+		}
+
+		close(stopC)
+		master.Close()
+	}
+}
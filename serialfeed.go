@@ -0,0 +1,188 @@
+package main
+
+// This module implements a reader for portal status information that is
+// delivered as line delimited JSon over a serial device, as is the case
+// for tecthulhu modules attached directly to the Pi.  URIs take the form
+// serial:///dev/ttyUSB0?baud=115200
+//
+// Serial lines are noisy when devices are plugged in, reset or opened part
+// way through a transmission so any line that does not contain a parsable
+// JSon document is discarded and the reader resynchronizes on the next
+// line terminator.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	// Lines longer than this are assumed to be garbage, a portal status
+	// document is typically only a few kilobytes in size
+	maxSerialLine = 64 * 1024
+
+	// serialReadTimeout is the time a read waits for data, and
+	// serialHangups is the number of reads in a row that can return
+	// immediately without data before the device is assumed to have
+	// been disconnected
+	serialReadTimeout = time.Second
+	serialHangups     = 3
+
+	// serialRetry is the time waited before a failed device is reopened
+	serialRetry = 2 * time.Second
+)
+
+type serialFeed struct {
+	uri     string // The URI as given, used to tag the statuses and errors
+	url     *url.URL
+	decode  func(line []byte) (*portalStatus, error)
+	statusC chan *portalStatus
+	errorC  chan error
+
+	retry time.Duration // The time waited before reopening the device, serialRetry when not set
+}
+
+// start opens the serial device and continuously reads portal status
+// documents from it, reopening the device after any failures until
+// the quitC channel is closed
+//
+func (feed *serialFeed) start(quitC chan bool) (err error) {
+	retry := feed.retry
+	if retry == 0 {
+		retry = serialRetry
+	}
+
+	for {
+		if err = feed.run(quitC); err == nil {
+			return nil
+		}
+		publishError(fmt.Errorf("portal status for %s could not be retrieved due to %s", feed.uri, err.Error()), feed.errorC)
+
+		select {
+		case <-time.After(retry):
+		case <-quitC:
+			return nil
+		}
+	}
+}
+
+func (feed *serialFeed) baud() (baud int, err error) {
+	baudStr := feed.url.Query().Get("baud")
+	if len(baudStr) == 0 {
+		return 9600, nil
+	}
+	if baud, err = strconv.Atoi(baudStr); err != nil {
+		return 0, fmt.Errorf("invalid baud rate '%s' for %s", baudStr, feed.url.String())
+	}
+	return baud, nil
+}
+
+// run processes the serial device until the device fails, in which case
+// an error is returned, or the quitC channel is closed
+//
+func (feed *serialFeed) run(quitC chan bool) (err error) {
+
+	baud, err := feed.baud()
+	if err != nil {
+		return err
+	}
+
+	port, err := serial.OpenPort(&serial.Config{Name: feed.url.Path, Baud: baud, ReadTimeout: serialReadTimeout})
+	if err != nil {
+		return err
+	}
+
+	// Closing the port on exit, or when asked to quit, will release
+	// any pending reads
+	doneC := make(chan bool)
+	defer close(doneC)
+
+	go func() {
+		select {
+		case <-quitC:
+		case <-doneC:
+		}
+		port.Close()
+	}()
+
+	reader := bufio.NewReader(port)
+	line := make([]byte, 0, 1024)
+	overflow := false
+	hangups := 0
+
+	for {
+		started := time.Now()
+		chunk, err := reader.ReadSlice('\n')
+
+		select {
+		case <-quitC:
+			return nil
+		default:
+		}
+
+		if len(chunk) != 0 && !overflow {
+			line = append(line, chunk...)
+		}
+
+		switch err {
+		case nil:
+			if !overflow {
+				feed.frame(line)
+			}
+			line = line[:0]
+			overflow = false
+		case bufio.ErrBufferFull, io.EOF:
+			// Lines can arrive in pieces, io.EOF is used by the serial
+			// device to indicate a read timeout.  A device that has been
+			// disconnected also returns io.EOF, but without waiting
+			if err == io.EOF && len(chunk) == 0 && time.Since(started) < serialReadTimeout/10 {
+				if hangups++; hangups >= serialHangups {
+					return fmt.Errorf("%s was disconnected", feed.url.Path)
+				}
+			} else {
+				hangups = 0
+			}
+			if len(line) > maxSerialLine {
+				logW.Debug(fmt.Sprintf("discarding oversized line from %s", feed.url.String()))
+				line = line[:0]
+				overflow = true
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// frame extracts a single JSon document from a line of input, skipping
+// any leading garbage, and passes the decoded status to the gateway
+//
+func (feed *serialFeed) frame(line []byte) {
+
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	start := bytes.IndexByte(line, '{')
+	if start < 0 {
+		logW.Debug(fmt.Sprintf("discarding %q from %s", line, feed.url.String()))
+		return
+	}
+	if start != 0 {
+		logW.Debug(fmt.Sprintf("discarding %q from %s", line[:start], feed.url.String()))
+	}
+
+	status, err := feed.decode(line[start:])
+	if err != nil {
+		logW.Debug(fmt.Sprintf("resynchronizing %s after %s", feed.url.String(), err.Error()))
+		return
+	}
+
+	publishStatus(feed.uri, status, feed.statusC, feed.errorC)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty opens a new pseudo terminal returning the master end and the name
+// of the slave device
+//
+func openPty(t *testing.T) (master *os.File, slave string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip(fmt.Sprintf("pseudo terminals are not available, %s", err.Error()))
+	}
+	if err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// expectStatus waits for a status from the feed, writing the lines to the
+// master end of the pty until one arrives as the feed may not yet have the
+// device open
+//
+func expectStatus(t *testing.T, master *os.File, lines string, title string, statusC chan *portalStatus) {
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(10 * time.Second)
+
+	master.Write([]byte(lines))
+	for {
+		select {
+		case status := <-statusC:
+			if status.Status.Title != title {
+				t.Fatalf("expected the status of '%s' but got '%s'", title, status.Status.Title)
+			}
+			if u, err := url.Parse(status.Source); err != nil || u.Scheme != "serial" {
+				t.Fatalf("expected the status to come from the serial feed, not '%s'", status.Source)
+			}
+			return
+		case <-tick.C:
+			master.Write([]byte(lines))
+		case <-timeout:
+			t.Fatalf("timed out waiting for the status of '%s'", title)
+		}
+	}
+}
+
+func TestSerialFeed(t *testing.T) {
+
+	master, slave := openPty(t)
+	defer master.Close()
+
+	// The feed opens the pty using a link so that the link can be moved to
+	// a new pty once the first is closed
+	dir, err := ioutil.TempDir("", "serialfeed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, "tty")
+	if err = os.Symlink(slave, link); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "serial://" + link + "?baud=115200"
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusC := make(chan *portalStatus, 10)
+	errorC := make(chan error, 10)
+	quitC := make(chan bool)
+	defer close(quitC)
+
+	feed := &serialFeed{uri: uri, url: u, decode: decodeTecthulhu, statusC: statusC, errorC: errorC, retry: 100 * time.Millisecond}
+	go feed.start(quitC)
+
+	// Noise and partial documents are skipped, a single status is sent
+	// until the feed has opened the device
+	expectStatus(t, master, "garbage\r\nxx{\"status\":{\"title\":\"A\",\"controllingFaction\":\"1\"}}\r\n{bad\n", "A", statusC)
+
+	// Closing the pty disconnects the feed, which reports the error and
+	// reopens the device once it is available again
+	master.Close()
+
+	master, slave = openPty(t)
+	defer master.Close()
+	if err = os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(slave, link); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errorC:
+		t.Log(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the disconnection of the pty was not reported")
+	}
+
+	expectStatus(t, master, "{\"status\":{\"title\":\"B\"}}\n", "B", statusC)
+}
@@ -0,0 +1,353 @@
+package main
+
+// This module implements a client for servers that push portal status
+// updates to the gateway as they occur rather than waiting to be polled.
+// Two forms of subscription are supported, WebSockets using ws:// and
+// wss:// URIs, and Server-Sent Events using sse+http:// and sse+https://
+// URIs.  Each WebSocket message, or SSE event, is expected to contain a
+// single JSon document.
+//
+// Servers only send updates when a portal changes, so a quiet stream is kept
+// healthy using the WebSocket pongs and the SSE comments that show it is still
+// up, rather than by repeating the last status.  Server-Sent Event streams
+// that go quiet, with neither events nor comments arriving for several poll
+// intervals, are assumed to be half open and are dropped.
+//
+// When the stream cannot be established, or drops, the same server is
+// polled using HTTP until the stream can be re-established.  By default the
+// poll URI is derived from the stream URI, for example ws://host/path is
+// polled using http://host/path, and this can be overridden using a poll
+// query parameter.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How long the fall back to polling lasts before an attempt is made
+	// to re-establish the stream
+	streamRetry = 30 * time.Second
+
+	// Pings are used to detect WebSockets that have silently gone away, and
+	// are sent more often when needed to keep the source from going stale
+	streamPing = 20 * time.Second
+
+	// The number of poll intervals that an event stream can go without
+	// receiving anything before it is dropped
+	streamIdlePolls = 5
+)
+
+// poller is implemented by the sources that are able to retrieve the
+// portal status on demand
+//
+type poller interface {
+	checkPortal() (status *portalStatus, err error)
+	pollDelay() (delay time.Duration)
+}
+
+type streamer struct {
+	url     string
+	decode  func(body []byte) (*portalStatus, error)
+	poll    poller
+	statusC chan *portalStatus
+	errorC  chan error
+}
+
+// newStreamer creates a streaming client for the stream URI, the concentrator
+// flag indicates that the stream carries the concentrator rather than the
+// tecthulhu JSon format
+//
+func newStreamer(uri string, concentratorFormat bool, statusC chan *portalStatus, errorC chan error) (stream *streamer, err error) {
+
+	streamURL, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	pollURL := *streamURL
+	switch streamURL.Scheme {
+	case "ws", "sse+http":
+		pollURL.Scheme = "http"
+	case "wss", "sse+https":
+		pollURL.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("Unknown scheme %s for a streamed portal URI", streamURL.Scheme)
+	}
+
+	query := streamURL.Query()
+	if override := query.Get("poll"); len(override) != 0 {
+		overrideURL, err := url.Parse(override)
+		if err != nil {
+			return nil, err
+		}
+		pollURL = *overrideURL
+	}
+
+	stream = &streamer{
+		url:     uri,
+		decode:  decodeTecthulhu,
+		statusC: statusC,
+		errorC:  errorC,
+	}
+
+	if concentratorFormat {
+		stream.decode = decodeConcentrator
+		stream.poll = &concentrator{url: pollURL.String(), statusC: statusC, errorC: errorC}
+	} else {
+		stream.poll = &tecthulhu{url: pollURL.String(), statusC: statusC, errorC: errorC}
+	}
+	return stream, nil
+}
+
+// subscribeURL returns the URI used for the subscription, without the
+// parameters intended for the gateway
+//
+func (stream *streamer) subscribeURL() (subURL *url.URL, err error) {
+	if subURL, err = url.Parse(stream.url); err != nil {
+		return nil, err
+	}
+	query := subURL.Query()
+	query.Del("poll")
+	subURL.RawQuery = query.Encode()
+	subURL.Scheme = strings.TrimPrefix(subURL.Scheme, "sse+")
+	return subURL, nil
+}
+
+// startPortals subscribes to the server and passes each update to the
+// gateway as it arrives, falling back to polling whenever the stream is
+// not available
+//
+func (stream *streamer) startPortals(quitC chan bool) (err error) {
+	for {
+		if err = stream.subscribe(quitC); err == nil {
+			return nil
+		}
+
+		publishError(fmt.Errorf("portal stream %s is unavailable due to %s, polling instead", stream.url, err.Error()), stream.errorC)
+
+		if quit := stream.fallback(quitC); quit {
+			return nil
+		}
+		logW.Info(fmt.Sprintf("reconnecting portal stream %s", stream.url))
+	}
+}
+
+// fallback polls the server for the period of time after which the stream
+// should be retried, the return value indicating if the gateway is stopping
+//
+func (stream *streamer) fallback(quitC chan bool) (quit bool) {
+
+	retry := time.After(streamRetry)
+
+	for {
+		select {
+		case <-time.After(stream.poll.pollDelay()):
+			status, err := stream.poll.checkPortal()
+			if err != nil {
+				publishError(fmt.Errorf("portal status for %s could not be retrieved due to %s", stream.url, err.Error()), stream.errorC)
+				continue
+			}
+			publishStatus(stream.url, status, stream.statusC, stream.errorC)
+		case <-retry:
+			return false
+		case <-quitC:
+			return true
+		}
+	}
+}
+
+// subscribe returns nil when the gateway is stopping and otherwise the
+// error that caused the stream to be lost
+//
+func (stream *streamer) subscribe(quitC chan bool) (err error) {
+	subURL, err := stream.subscribeURL()
+	if err != nil {
+		return err
+	}
+
+	switch subURL.Scheme {
+	case "ws", "wss":
+		err = stream.websocket(subURL, quitC)
+	default:
+		err = stream.events(subURL, quitC)
+	}
+
+	select {
+	case <-quitC:
+		return nil
+	default:
+	}
+	return err
+}
+
+func (stream *streamer) update(body []byte) {
+	status, err := stream.decode(body)
+	if err != nil {
+		publishError(fmt.Errorf("portal stream %s sent bad data %s", stream.url, err.Error()), stream.errorC)
+		return
+	}
+
+	publishStatus(stream.url, status, stream.statusC, stream.errorC)
+}
+
+func (stream *streamer) websocket(subURL *url.URL, quitC chan bool) (err error) {
+
+	dialer := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.Dial(subURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	doneC := make(chan bool)
+	defer close(doneC)
+
+	interval := streamPing
+	if *staleAfter/2 < interval {
+		interval = *staleAfter / 2
+	}
+
+	// Closing the connection releases the reader when the gateway is stopping,
+	// pings are sent to detect servers that have silently gone away
+	go func() {
+		ping := time.NewTicker(interval)
+		defer ping.Stop()
+		defer conn.Close()
+
+		for {
+			select {
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second)); err != nil {
+					return
+				}
+			case <-quitC:
+				return
+			case <-doneC:
+				return
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(2 * interval))
+	conn.SetPongHandler(func(string) error {
+		publishAlive(stream.url)
+		return conn.SetReadDeadline(time.Now().Add(2 * interval))
+	})
+
+	logW.Info(fmt.Sprintf("subscribed to portal stream %s", stream.url))
+	publishAlive(stream.url)
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * interval))
+		stream.update(msg)
+	}
+}
+
+func (stream *streamer) events(subURL *url.URL, quitC chan bool) (err error) {
+
+	req, err := http.NewRequest("GET", subURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	// The stream has no overall timeout, only the connection
+	// setup is bounded
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:                  (&net.Dialer{Timeout: 10 * time.Second}).Dial,
+			ResponseHeaderTimeout: 10 * time.Second,
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	doneC := make(chan bool)
+	defer close(doneC)
+
+	// Closing the body releases the reader when the gateway is stopping, or
+	// when nothing has been read for too long as a half open connection
+	// would otherwise leave the reader blocked forever
+	idleLimit := streamIdlePolls * *pollInterval
+	lastRead := time.Now().UnixNano()
+	idleC := make(chan bool)
+
+	go func() {
+		defer resp.Body.Close()
+
+		check := time.NewTicker(idleLimit / 4)
+		defer check.Stop()
+
+		for {
+			select {
+			case <-check.C:
+				if time.Since(time.Unix(0, atomic.LoadInt64(&lastRead))) > idleLimit {
+					close(idleC)
+					return
+				}
+			case <-quitC:
+				return
+			case <-doneC:
+				return
+			}
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	logW.Info(fmt.Sprintf("subscribed to portal stream %s", stream.url))
+	publishAlive(stream.url)
+
+	// Events are made up of one or more data lines and are terminated
+	// by a blank line, other fields and comments are not used
+	data := &bytes.Buffer{}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		atomic.StoreInt64(&lastRead, time.Now().UnixNano())
+		publishAlive(stream.url)
+
+		line := scanner.Text()
+		switch {
+		case len(line) == 0:
+			if data.Len() != 0 {
+				stream.update(data.Bytes())
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() != 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	select {
+	case <-idleC:
+		return fmt.Errorf("nothing was received for %s", idleLimit.String())
+	default:
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by the server")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamDoc returns a tecthulhu status document for the portal
+//
+func streamDoc(title string) string {
+	return fmt.Sprintf(`{"status":{"title":"%s","controllingFaction":"1"}}`, title)
+}
+
+// streamSource starts the source for the uri, the returned function stops the
+// source and waits for it to finish
+//
+func streamSource(t *testing.T, uri string) (statusC chan *portalStatus, errorC chan error, stop func()) {
+
+	statusC = make(chan *portalStatus, 10)
+	errorC = make(chan error, 10)
+	quitC := make(chan bool)
+	doneC := make(chan bool)
+
+	source, err := newSource(uri, false, statusC, errorC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		source.startPortals(quitC)
+		close(doneC)
+	}()
+
+	return statusC, errorC, func() {
+		close(quitC)
+		select {
+		case <-doneC:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the source did not stop")
+		}
+	}
+}
+
+// expectTitle waits for a status, skipping any that repeat the previous portal
+//
+func expectTitle(t *testing.T, statusC chan *portalStatus, uri string, title string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case status := <-statusC:
+			if status.Source != uri {
+				t.Fatalf("expected the status to come from %s, not %s", uri, status.Source)
+			}
+			if status.Status.Title == title {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for the status of '%s'", title)
+		}
+	}
+}
+
+// setPollInterval shortens the poll interval for a test, returning a function
+// that restores it
+//
+func setPollInterval(interval time.Duration) (restore func()) {
+	saved := *pollInterval
+	*pollInterval = interval
+	return func() { *pollInterval = saved }
+}
+
+func TestStreamWebSocket(t *testing.T) {
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(streamDoc("A")))
+		conn.WriteMessage(websocket.TextMessage, []byte(streamDoc("B")))
+
+		// Hold the connection open until the client goes away
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	uri := "ws" + strings.TrimPrefix(server.URL, "http") + "/status"
+	statusC, _, stop := streamSource(t, uri)
+	defer stop()
+
+	expectTitle(t, statusC, uri, "A")
+	expectTitle(t, statusC, uri, "B")
+}
+
+func TestStreamEvents(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			t.Errorf("the stream was polled")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		// Comments and other fields are ignored and documents can be split
+		// over several data lines
+		fmt.Fprintf(w, ": welcome\nevent: status\ndata: %s\n\n", streamDoc("A"))
+		w.(http.Flusher).Flush()
+		fmt.Fprintf(w, "data: {\"status\":\ndata: {\"title\":\"B\"}}\n\n")
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	uri := "sse+" + server.URL + "/events"
+	statusC, _, stop := streamSource(t, uri)
+	defer stop()
+
+	expectTitle(t, statusC, uri, "A")
+	expectTitle(t, statusC, uri, "B")
+}
+
+func TestStreamIdle(t *testing.T) {
+
+	defer setPollInterval(50 * time.Millisecond)()
+
+	// The event stream sends a single event and then goes quiet without
+	// closing the connection, as a half open connection would
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			fmt.Fprint(w, streamDoc("polled"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", streamDoc("streamed"))
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	uri := "sse+" + server.URL + "/events"
+	statusC, errorC, stop := streamSource(t, uri)
+	defer stop()
+
+	expectTitle(t, statusC, uri, "streamed")
+
+	select {
+	case err := <-errorC:
+		if !strings.Contains(err.Error(), "nothing was received") {
+			t.Fatalf("expected the stream to be dropped as idle, not %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle stream was not dropped")
+	}
+
+	expectTitle(t, statusC, uri, "polled")
+}
+
+func TestStreamFallback(t *testing.T) {
+
+	defer setPollInterval(50 * time.Millisecond)()
+
+	// The stream cannot be established, the same server is polled instead
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "text/event-stream" {
+			http.Error(w, "streaming is not available", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, streamDoc("polled"))
+	}))
+	defer server.Close()
+
+	uri := "sse+" + server.URL + "/events"
+	statusC, errorC, stop := streamSource(t, uri)
+	defer stop()
+
+	select {
+	case err := <-errorC:
+		if !strings.Contains(err.Error(), "polling instead") {
+			t.Fatalf("expected the stream to fall back to polling, not %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed stream was not reported")
+	}
+
+	expectTitle(t, statusC, uri, "polled")
+}
@@ -3,10 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -40,6 +37,7 @@ type tecthulhu struct {
 	url     string
 	statusC chan *portalStatus
 	errorC  chan error
+	http    *httpPoller
 }
 
 func (tec *tPortalStatus) Status() (state *portalStatus) {
@@ -74,81 +72,90 @@ func (tec *tPortalStatus) Status() (state *portalStatus) {
 	}
 	for i, modStr := range tec.State.Mods {
 		newMod := mod{Slot: float32(i)}
-		modParts := strings.Split(modStr, "-")
-		if len(modParts) == 2 {
-			switch modParts[1] {
-			case "C":
-				newMod.Rarity = "Common"
-			case "R":
-				newMod.Rarity = "Rare"
-			case "VR":
-				newMod.Rarity = "Very Rare"
-			}
-		}
-		switch modParts[0] {
-		case "FA":
-			newMod.Type = "Force Amplifier"
-		case "HS":
-			newMod.Type = "Heat Sink"
-		case "LA":
-			newMod.Type = "Link Amplifier"
-		case "SBUL":
-			newMod.Type = "SoftBank UltraLink"
-		case "MH":
-			newMod.Type = "Multi-hack"
-		case "PS":
-			newMod.Type = "Portal Shield"
-		case "AXA":
-			newMod.Type = "AXA Shield"
-		case "T":
-			newMod.Type = "Turret"
+		if kind, ok := modByCode(modStr); ok {
+			newMod.Type = kind.typ
+			newMod.Rarity = kind.rarity
+		} else {
+			// Unknown mods keep their code so that they can be
+			// reported and passed on unchanged
+			newMod.Type = modStr
 		}
 		state.Status.Mods = append(state.Status.Mods, newMod)
 	}
 	return state
 }
 
+// tecthulhuStatus converts a portal status in the canonical format into the
+// tecthulhu specific format, the reverse of the Status method
+//
+func tecthulhuStatus(state *portalStatus) (tec *tPortalStatus) {
+	tec = &tPortalStatus{
+		State: tStatus{
+			Title:      state.Status.Title,
+			Owner:      state.Status.Owner,
+			Level:      int(state.Status.Level),
+			Health:     int(state.Status.Health),
+			Mods:       []string{},
+			Resonators: []resonator{},
+		},
+	}
+	tec.State.Resonators = append(tec.State.Resonators, state.Status.Resonators...)
+
+	switch state.Status.ControllingFaction {
+	case "Enlightened":
+		tec.State.ControllingFaction = "1"
+	case "Resistance":
+		tec.State.ControllingFaction = "2"
+	default:
+		tec.State.ControllingFaction = "0"
+	}
+	for _, mod := range state.Status.Mods {
+		if kind, ok := modByName(mod.Type, mod.Rarity); ok {
+			tec.State.Mods = append(tec.State.Mods, kind.code)
+			continue
+		}
+		logW.Warn(fmt.Sprintf("unknown mod type '%s' rarity '%s'", mod.Type, mod.Rarity))
+		tec.State.Mods = append(tec.State.Mods, mod.Type)
+	}
+	return tec
+}
+
+// decodeTecthulhu parses a single JSON document in the tecthulhu specific
+// format and converts it to the canonical format used by the concentrator
+// which we assume is a reference format for portal data and meta data
+//
+func decodeTecthulhu(body []byte) (status *portalStatus, err error) {
+	tecStatus := &tPortalStatus{}
+
+	if err = json.Unmarshal(body, &tecStatus); err != nil {
+		logW.Debug(string(body))
+		return nil, err
+	}
+	return tecStatus.Status(), nil
+}
+
 // checkPortal can be used to extract status information from the portal
 //
 func (tec *tecthulhu) checkPortal() (status *portalStatus, err error) {
 
-	body := []byte{}
 	url, err := url.Parse(tec.url)
 	if err != nil {
 		return nil, err
 	}
 
 	switch url.Scheme {
-	case "http":
-		resp, err := http.Get(tec.url)
-		if err != nil {
-			return nil, err
-		}
-
-		body, err = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, err
+	case "http", "https":
+		if tec.http == nil {
+			tec.http = newHTTPPoller()
 		}
+		return tec.http.poll(url.String(), decodeTecthulhu)
 
 	case "serial":
-		return nil, fmt.Errorf("Unknown scheme %s for the tecthulhu device is not yet implemented", url.Scheme)
+		return nil, fmt.Errorf("scheme %s for the tecthulhu device is streamed and cannot be polled", url.Scheme)
 
 	default:
 		return nil, fmt.Errorf("Unknown scheme %s for the tecthulhu device URI", url.Scheme)
 	}
-
-	// Parse into the tecthulhu specific format and then convert to
-	// the canonical format used by the concentrator which we assume
-	// is a reference format for portal data and meta data
-	//
-	tecStatus := &tPortalStatus{}
-
-	err = json.Unmarshal(body, &tecStatus)
-	if err != nil {
-		logW.Debug(string(body))
-	}
-	return tecStatus.Status(), err
 }
 
 func (tec *tecthulhu) getStatus() {
@@ -160,28 +167,11 @@ func (tec *tecthulhu) getStatus() {
 	status, err := tec.checkPortal()
 
 	if err != nil {
-		err = fmt.Errorf("portal status for %s could not be retrieved due to %s", tec.url, err.Error())
-		go func() {
-			select {
-			case tec.errorC <- err:
-			case <-time.After(500 * time.Millisecond):
-				logW.Warn(fmt.Sprintf("could not send, error for ignored portal status update %s", err.Error()))
-			}
-		}()
+		publishError(fmt.Errorf("portal status for %s could not be retrieved due to %s", tec.url, err.Error()), tec.errorC)
 		return
 	}
 
-	select {
-	case tec.statusC <- status:
-	case <-time.After(750 * time.Millisecond):
-		go func() {
-			select {
-			case tec.errorC <- fmt.Errorf("portal status for %s had to be skipped", tec.url):
-			case <-time.After(2 * time.Second):
-				logW.Warn("could not send error for ignored portal status update")
-			}
-		}()
-	}
+	publishStatus(tec.url, status, tec.statusC, tec.errorC)
 }
 
 // startPortal listens to a tecthulhu device and returns
@@ -190,15 +180,35 @@ func (tec *tecthulhu) getStatus() {
 //
 func (tec *tecthulhu) startPortals(quitC chan bool) (err error) {
 
-	poll := time.NewTicker(2 * time.Second)
-	defer poll.Stop()
+	// Serial devices push line delimited JSon at their own pace
+	// and so are read continuously rather than being polled
+	if devURL, err := url.Parse(tec.url); err == nil && devURL.Scheme == "serial" {
+		feed := &serialFeed{
+			uri:     tec.url,
+			url:     devURL,
+			decode:  decodeTecthulhu,
+			statusC: tec.statusC,
+			errorC:  tec.errorC,
+		}
+		return feed.start(quitC)
+	}
 
 	for {
 		select {
-		case <-poll.C:
+		case <-time.After(tec.pollDelay()):
 			tec.getStatus()
 		case <-quitC:
 			return
 		}
 	}
 }
+
+// pollDelay returns the time to wait before the next status check, this
+// grows while the tecthulhu is failing
+//
+func (tec *tecthulhu) pollDelay() (delay time.Duration) {
+	if tec.http == nil {
+		return *pollInterval
+	}
+	return tec.http.delay()
+}
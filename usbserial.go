@@ -0,0 +1,147 @@
+package main
+
+// This module implements the discovery of USB serial devices by reading sysfs
+// directly, rather than depending upon udevadm and a shell.  Every USB device
+// listed in /sys/bus/usb/devices is examined for interfaces that have a tty,
+// either as a tty directory for CDC ACM devices such as the arduinos, or as a
+// ttyUSB directory for USB to UART bridges, and the tty is confirmed using
+// /sys/class/tty.
+//
+// The root of the sysfs tree, sysfsRoot, can be changed so that a copy of the
+// tree, or a fake one, is used in place of /sys.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sysfsRoot is the root of the sysfs tree in which devices are discovered
+var sysfsRoot = "/sys"
+
+// usbSerialDevice describes a tty provided by a USB device
+//
+type usbSerialDevice struct {
+	Path         string // The device name, for example /dev/ttyACM0
+	SysPath      string // The sysfs directory of the USB device
+	VendorID     string
+	ProductID    string
+	Serial       string
+	Manufacturer string
+	Product      string
+}
+
+func (dev *usbSerialDevice) String() string {
+	return fmt.Sprintf("%s %s:%s '%s' '%s' serial # '%s'", dev.Path, dev.VendorID, dev.ProductID, dev.Manufacturer, dev.Product, dev.Serial)
+}
+
+// readAttr returns the value of a sysfs attribute, or an empty string when the
+// attribute is not present
+//
+func readAttr(dir string, name string) (value string) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// interfaceTTYs returns the names of the ttys belonging to a USB interface
+//
+func interfaceTTYs(iface string) (ttys []string) {
+	ttys = []string{}
+
+	// CDC ACM devices place their ttys in a tty directory
+	if entries, err := ioutil.ReadDir(filepath.Join(iface, "tty")); err == nil {
+		for _, entry := range entries {
+			ttys = append(ttys, entry.Name())
+		}
+	}
+
+	// USB serial converters have a directory for each port
+	if entries, err := ioutil.ReadDir(iface); err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "ttyUSB") {
+				ttys = append(ttys, entry.Name())
+			}
+		}
+	}
+	return ttys
+}
+
+// enumerateUSBSerial lists the ttys provided by the USB devices found in the
+// sysfs tree at root
+//
+func enumerateUSBSerial(root string) (devices []usbSerialDevice, err error) {
+
+	busDir := filepath.Join(root, "bus", "usb", "devices")
+	entries, err := ioutil.ReadDir(busDir)
+	if err != nil {
+		return nil, err
+	}
+
+	devices = []usbSerialDevice{}
+
+	for _, entry := range entries {
+		// Interfaces, such as 1-1.2:1.0, are visited through their device
+		if strings.Contains(entry.Name(), ":") {
+			continue
+		}
+
+		usbDir := filepath.Join(busDir, entry.Name())
+		vendor := readAttr(usbDir, "idVendor")
+		if len(vendor) == 0 {
+			continue
+		}
+
+		ifaces, err := ioutil.ReadDir(usbDir)
+		if err != nil {
+			continue
+		}
+		for _, iface := range ifaces {
+			if !strings.HasPrefix(iface.Name(), entry.Name()+":") {
+				continue
+			}
+			for _, tty := range interfaceTTYs(filepath.Join(usbDir, iface.Name())) {
+				if _, err := os.Stat(filepath.Join(root, "class", "tty", tty)); err != nil {
+					continue
+				}
+				devices = append(devices, usbSerialDevice{
+					Path:         "/dev/" + tty,
+					SysPath:      usbDir,
+					VendorID:     vendor,
+					ProductID:    readAttr(usbDir, "idProduct"),
+					Serial:       readAttr(usbDir, "serial"),
+					Manufacturer: readAttr(usbDir, "manufacturer"),
+					Product:      readAttr(usbDir, "product"),
+				})
+			}
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Path < devices[j].Path })
+	return devices, nil
+}
+
+// arduinoVendors are the USB vendor IDs used by genuine arduino boards
+var arduinoVendors = map[string]bool{
+	"2341": true,
+	"2a03": true,
+}
+
+// isArduino tests whether a USB serial device is likely to be an arduino,
+// either a board identifying itself as an arduino or a USB to UART bridge
+// such as those used by arduino compatible boards
+//
+func (dev *usbSerialDevice) isArduino() bool {
+	if arduinoVendors[strings.ToLower(dev.VendorID)] {
+		return true
+	}
+	if strings.Contains(strings.ToLower(dev.Manufacturer+" "+dev.Product), "arduino") {
+		return true
+	}
+	return strings.HasPrefix(filepath.Base(dev.Path), "ttyUSB") && strings.Contains(strings.ToUpper(dev.Product), "UART")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeUSB describes a USB device to be added to a fake sysfs tree
+//
+type fakeUSB struct {
+	busID   string
+	vendor  string
+	product string
+	serial  string
+	name    string
+	tty     string // The tty of the first interface, if any
+	acm     bool   // CDC ACM devices place their tty in a tty directory
+	class   bool   // Whether the tty is listed in /sys/class/tty
+}
+
+// fakeSysfs builds a sysfs tree, laid out as the kernel does, holding the
+// USB devices.  The tree is removed by the returned function
+//
+func fakeSysfs(t *testing.T, devices []fakeUSB) (root string, remove func()) {
+
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdir := func(dir string) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(dir string, name string, value string) {
+		if len(value) == 0 {
+			return
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(target string, name string) {
+		rel, err := filepath.Rel(filepath.Dir(name), target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Symlink(rel, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bus := filepath.Join(root, "bus", "usb", "devices")
+	class := filepath.Join(root, "class", "tty")
+	mkdir(bus)
+	mkdir(class)
+
+	// The root hub has no interfaces with ttys
+	hub := filepath.Join(root, "devices", "pci0000:00", "0000:00:14.0", "usb1")
+	mkdir(filepath.Join(hub, "1-0:1.0"))
+	write(hub, "idVendor", "1d6b")
+	link(hub, filepath.Join(bus, "usb1"))
+	link(filepath.Join(hub, "1-0:1.0"), filepath.Join(bus, "1-0:1.0"))
+
+	for _, dev := range devices {
+		usbDir := filepath.Join(hub, dev.busID)
+		iface := filepath.Join(usbDir, dev.busID+":1.0")
+		mkdir(iface)
+		write(usbDir, "idVendor", dev.vendor)
+		write(usbDir, "idProduct", dev.product)
+		write(usbDir, "serial", dev.serial)
+		write(usbDir, "product", dev.name)
+		link(usbDir, filepath.Join(bus, dev.busID))
+		link(iface, filepath.Join(bus, dev.busID+":1.0"))
+
+		if len(dev.tty) == 0 {
+			continue
+		}
+
+		// /sys/class/tty/<tty> leads to the tty, whose device is the
+		// interface for ACM devices and the port for serial converters
+		ttyDir := filepath.Join(iface, "tty", dev.tty)
+		device := iface
+		if !dev.acm {
+			device = filepath.Join(iface, dev.tty)
+			ttyDir = filepath.Join(device, "tty", dev.tty)
+		}
+		mkdir(ttyDir)
+		link(device, filepath.Join(ttyDir, "device"))
+		if dev.class {
+			link(ttyDir, filepath.Join(class, dev.tty))
+		}
+	}
+
+	return root, func() { os.RemoveAll(root) }
+}
+
+var fakeDevices = []fakeUSB{
+	{busID: "1-1", vendor: "2341", product: "0043", serial: "85531303", name: "Arduino Uno", tty: "ttyACM0", acm: true, class: true},
+	{busID: "1-2", vendor: "10c4", product: "ea60", serial: "0001", name: "CP2102 USB to UART Bridge Controller", tty: "ttyUSB0", class: true},
+	{busID: "1-3", vendor: "1a86", product: "7523", name: "USB Serial", tty: "ttyUSB1", class: true},
+	{busID: "1-4", vendor: "1546", product: "01a7", serial: "GPS1", name: "u-blox GNSS receiver", tty: "ttyACM1", acm: true, class: true},
+	// A tty that the kernel has not yet listed, or is removing
+	{busID: "1-5", vendor: "2341", product: "0042", serial: "STALE", tty: "ttyACM2", acm: true},
+	// A keyboard, without a tty
+	{busID: "1-6", vendor: "046d", product: "c31c", name: "USB Keyboard"},
+}
+
+func TestEnumerateUSBSerial(t *testing.T) {
+
+	root, remove := fakeSysfs(t, fakeDevices)
+	defer remove()
+
+	devices, err := enumerateUSBSerial(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]string{}
+	for _, dev := range devices {
+		found[dev.Path] = dev.VendorID + ":" + dev.ProductID + " " + dev.Serial
+	}
+	expected := map[string]string{
+		"/dev/ttyACM0": "2341:0043 85531303",
+		"/dev/ttyACM1": "1546:01a7 GPS1",
+		"/dev/ttyUSB0": "10c4:ea60 0001",
+		"/dev/ttyUSB1": "1a86:7523 ",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected the devices %v, not %v", expected, found)
+	}
+	if devices[0].Path != "/dev/ttyACM0" || devices[0].Product != "Arduino Uno" {
+		t.Fatalf("expected the devices to be sorted and described, not %s first", devices[0].String())
+	}
+
+	if _, err = enumerateUSBSerial(filepath.Join(root, "missing")); err == nil {
+		t.Fatal("expected a missing sysfs tree to be reported")
+	}
+}
+
+func TestFindArduinos(t *testing.T) {
+
+	root, remove := fakeSysfs(t, fakeDevices)
+	defer remove()
+
+	saved := sysfsRoot
+	sysfsRoot = root
+	defer func() { sysfsRoot = saved }()
+
+	arduinos := func(registry *deviceRegistry) (paths []string) {
+		devices, err := findArduinos(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = []string{}
+		for _, dev := range devices {
+			paths = append(paths, dev.Path)
+		}
+		return paths
+	}
+
+	// Without a registry only the arduino vendors, and UART bridges, are
+	// tried
+	registry, _ := loadRegistry("")
+	if paths := arduinos(registry); !reflect.DeepEqual(paths, []string{"/dev/ttyACM0", "/dev/ttyUSB0"}) {
+		t.Fatalf("expected the arduinos ttyACM0 and ttyUSB0, not %v", paths)
+	}
+
+	// Boards can be added by serial number, or by vendor and product
+	registry.Devices = []*registeredDevice{{Serial: "GPS1", Name: "clock"}}
+	registry.bySerial["GPS1"] = registry.Devices[0]
+	registry.Profiles = []*serialProfile{{Vendor: "1A86", Product: "7523"}, {Vendor: "046d", Product: "c31c"}}
+	if paths := arduinos(registry); !reflect.DeepEqual(paths, []string{"/dev/ttyACM0", "/dev/ttyACM1", "/dev/ttyUSB0", "/dev/ttyUSB1"}) {
+		t.Fatalf("expected the registered devices to be added, not %v", paths)
+	}
+
+	registry.Profiles = []*serialProfile{{Vendor: "1a86", Product: "5523"}}
+	if paths := arduinos(registry); !reflect.DeepEqual(paths, []string{"/dev/ttyACM0", "/dev/ttyACM1", "/dev/ttyUSB0"}) {
+		t.Fatalf("expected a profile for another product to be ignored, not %v", paths)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+// This module implements the queue of lines waiting to be written to each
+// arduino.  Every device has its own queue and a goroutine writing the queue to
+// the device, so that a device that is slow, or stuck in flow control, only
+// delays its own lines rather than the gateway and the other devices.  When the
+// queue is full the oldest line is dropped, as newer lines describe the portal
+// more recently.  A write that does not complete within -writeTimeout takes the
+// device offline.  Those queueing lines are told once the lines have been
+// written, or that they were not, so that they can record what each device has
+// been sent.
+//
+// The depth of each queue and the number of lines dropped are served as JSon at
+// /devices when the -api option is used.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	writeQueueDepth = flag.Int("writeQueue", 8, "The number of lines that can be waiting to be written to each arduino before the oldest is dropped")
+	writeTimeout    = flag.Duration("writeTimeout", 2*time.Second, "The time allowed for a line to be written to an arduino before the device is taken offline")
+)
+
+// flushInterval is how often the output waiting to be sent to a device is
+// discarded while a write that has timed out is unblocked, flushAttempts is
+// how many times this is done before the write is abandoned
+//
+const (
+	flushInterval = 50 * time.Millisecond
+	flushAttempts = 20
+)
+
+var (
+	errDropped = errors.New("the line was dropped as the device is not keeping up")
+	errStopped = errors.New("the device was taken offline")
+)
+
+// queuedLine is a line waiting to be written along with the function, if
+// any, that is told whether it was written
+//
+type queuedLine struct {
+	line []byte
+	sent func(err error)
+}
+
+// report tells the sender of the line whether it was written
+//
+func (queued *queuedLine) report(err error) {
+	if queued.sent != nil {
+		queued.sent(err)
+	}
+}
+
+// writeQueue holds the lines waiting to be written to a device, along with
+// the counts of the lines that have passed through it
+//
+type writeQueue struct {
+	lines   []queuedLine
+	limit   int
+	stopped bool
+
+	queued  uint64
+	written uint64
+	dropped uint64
+	failed  uint64
+
+	// Set once lines have been dropped, until the queue next empties, so
+	// that a burst of drops is only logged once
+	dropping bool
+
+	sync.Mutex
+	ready *sync.Cond
+}
+
+// queueStats is a snapshot of the queue of a device
+//
+type queueStats struct {
+	Depth   int    `json:"depth"`
+	Limit   int    `json:"limit"`
+	Queued  uint64 `json:"queued"`
+	Written uint64 `json:"written"`
+	Dropped uint64 `json:"dropped"`
+	Failed  uint64 `json:"failed"`
+}
+
+func newWriteQueue(limit int) (queue *writeQueue) {
+	if limit < 1 {
+		limit = 1
+	}
+	queue = &writeQueue{
+		lines: make([]queuedLine, 0, limit),
+		limit: limit,
+	}
+	queue.ready = sync.NewCond(queue)
+	return queue
+}
+
+// push adds lines to the queue, dropping the oldest lines when the queue is
+// full.  The lines that were dropped, or all of the lines when the queue has
+// been stopped, are returned so that their senders can be told once the
+// queue is unlocked, and warn is set for the first lines dropped when the
+// device falls behind
+//
+func (queue *writeQueue) push(lines []queuedLine) (dropped []queuedLine, warn bool) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if queue.stopped {
+		return lines, false
+	}
+
+	for _, line := range lines {
+		if len(queue.lines) >= queue.limit {
+			dropped = append(dropped, queue.lines[0])
+			queue.lines = queue.lines[1:]
+		}
+		queue.lines = append(queue.lines, line)
+		queue.queued++
+	}
+	queue.dropped += uint64(len(dropped))
+
+	queue.ready.Signal()
+
+	if len(dropped) != 0 && !queue.dropping {
+		queue.dropping = true
+		return dropped, true
+	}
+	return dropped, false
+}
+
+// next waits for the oldest line in the queue, ok is false once the queue has
+// been stopped
+//
+func (queue *writeQueue) next() (line queuedLine, ok bool) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for len(queue.lines) == 0 && !queue.stopped {
+		queue.dropping = false
+		queue.ready.Wait()
+	}
+	if queue.stopped {
+		return line, false
+	}
+
+	line = queue.lines[0]
+	queue.lines = queue.lines[1:]
+	return line, true
+}
+
+// done counts a line that has been written, or has failed
+//
+func (queue *writeQueue) done(err error) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if err != nil {
+		queue.failed++
+		return
+	}
+	queue.written++
+}
+
+// stop discards the lines waiting in the queue and wakes the writer so that
+// it can finish, the lines discarded are returned so that their senders can
+// be told
+//
+func (queue *writeQueue) stop() (discarded []queuedLine) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	discarded = queue.lines
+	queue.stopped = true
+	queue.lines = nil
+	queue.ready.Broadcast()
+	return discarded
+}
+
+// queueBatch reports the outcome of writing a group of lines, once every line
+// has been written or as soon as one of them is not
+//
+type queueBatch struct {
+	remaining int
+	sent      func(err error)
+	sync.Mutex
+}
+
+func (batch *queueBatch) report(err error) {
+	batch.Lock()
+	batch.remaining--
+	sent := batch.sent
+	if err == nil && batch.remaining != 0 {
+		sent = nil
+	}
+	if sent != nil {
+		batch.sent = nil
+	}
+	batch.Unlock()
+
+	if sent != nil {
+		sent(err)
+	}
+}
+
+// queue adds lines to those waiting to be written to the device, returning
+// without waiting for them to be written.  When sent is given it is called,
+// from another goroutine, with nil once all of the lines have been written or
+// with the reason that they were not
+//
+func (dev *arduino) queue(lines [][]byte, sent func(err error)) {
+	if len(lines) == 0 {
+		return
+	}
+
+	queued := make([]queuedLine, 0, len(lines))
+	batch := &queueBatch{remaining: len(lines), sent: sent}
+	for _, line := range lines {
+		queued = append(queued, queuedLine{line: line, sent: batch.report})
+	}
+
+	dropped, warn := dev.outbox.push(queued)
+	if warn {
+		logW.Warn(fmt.Sprintf("arduino %s is not keeping up, dropped %d lines", dev.label(), len(dropped)))
+	}
+	for _, line := range dropped {
+		line.report(errDropped)
+	}
+}
+
+// writer writes the lines queued for the device until the device is closed,
+// taking the device offline should a write fail
+//
+func (dev *arduino) writer(outbox *writeQueue) {
+	for {
+		queued, ok := outbox.next()
+		if !ok {
+			return
+		}
+
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%v", r)
+				}
+			}()
+			return dev.sendCmd(queued.line)
+		}()
+		outbox.done(err)
+		queued.report(err)
+		if err != nil {
+			dev.offline(queued.line, err)
+			return
+		}
+	}
+}
+
+// stats returns a snapshot of the queue
+//
+func (queue *writeQueue) stats() (stats queueStats) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	return queueStats{
+		Depth:   len(queue.lines),
+		Limit:   queue.limit,
+		Queued:  queue.queued,
+		Written: queue.written,
+		Dropped: queue.dropped,
+		Failed:  queue.failed,
+	}
+}
+
+// write sends the bytes to the device, giving up once the write timeout has
+// passed.  Closing a device does not unblock a write that is in progress, so
+// a write that has timed out is unblocked by discarding the output waiting to
+// be sent to the device until the write completes, or until the device is
+// abandoned after flushAttempts.  Either way the caller takes the device
+// offline, which closes it
+//
+func (dev *arduino) write(cmd []byte) (err error) {
+
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- dev.writePort(cmd)
+	}()
+
+	timeout := time.NewTimer(*writeTimeout)
+	defer timeout.Stop()
+
+	select {
+	case err = <-doneC:
+		return err
+	case <-timeout.C:
+	}
+
+	for attempt := 0; attempt != flushAttempts; attempt++ {
+		dev.port.Flush()
+		select {
+		case <-doneC:
+			return fmt.Errorf("the write did not complete within %s", writeTimeout.String())
+		case <-time.After(flushInterval):
+		}
+	}
+
+	return fmt.Errorf("the write did not complete within %s and was abandoned", writeTimeout.String())
+}
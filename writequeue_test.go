@@ -0,0 +1,244 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// queueLines builds the lines to be queued, each reporting whether it was
+// written to the map of outcomes
+//
+func queueLines(outcomes map[string]error, lines ...string) (queued []queuedLine) {
+	for _, line := range lines {
+		line := line
+		queued = append(queued, queuedLine{
+			line: []byte(line),
+			sent: func(err error) { outcomes[line] = err },
+		})
+	}
+	return queued
+}
+
+func TestWriteQueue(t *testing.T) {
+
+	outcomes := map[string]error{}
+	queue := newWriteQueue(3)
+
+	if dropped, warn := queue.push(queueLines(outcomes, "a", "b")); len(dropped) != 0 || warn {
+		t.Fatalf("expected nothing to be dropped, not %d", len(dropped))
+	}
+
+	// The oldest lines are dropped once the queue is full, with a warning
+	// only for the first lines dropped until the queue next empties
+	dropped, warn := queue.push(queueLines(outcomes, "c", "d"))
+	if len(dropped) != 1 || string(dropped[0].line) != "a" || !warn {
+		t.Fatalf("expected a to be dropped with a warning, not %d lines", len(dropped))
+	}
+	dropped, warn = queue.push(queueLines(outcomes, "e"))
+	if len(dropped) != 1 || string(dropped[0].line) != "b" || warn {
+		t.Fatalf("expected b to be dropped without a warning, not %d lines", len(dropped))
+	}
+
+	written := []string{}
+	for i := 0; i != 3; i++ {
+		queued, ok := queue.next()
+		if !ok {
+			t.Fatal("expected a line to be waiting")
+		}
+		queue.done(nil)
+		queued.report(nil)
+		written = append(written, string(queued.line))
+	}
+	if !reflect.DeepEqual(written, []string{"c", "d", "e"}) {
+		t.Fatalf("expected the newest lines to be written, not %v", written)
+	}
+	if queue.queued != 5 || queue.written != 3 || queue.dropped != 2 {
+		t.Fatalf("expected 5 lines queued, 3 written and 2 dropped, not %d, %d and %d", queue.queued, queue.written, queue.dropped)
+	}
+
+	// Stopping the queue returns the lines waiting, and wakes the writer
+	queue.push(queueLines(outcomes, "f"))
+	if discarded := queue.stop(); len(discarded) != 1 || string(discarded[0].line) != "f" {
+		t.Fatalf("expected f to be discarded, not %d lines", len(discarded))
+	}
+	if _, ok := queue.next(); ok {
+		t.Fatal("expected the stopped queue to have no lines")
+	}
+	if dropped, _ := queue.push(queueLines(outcomes, "g")); len(dropped) != 1 {
+		t.Fatal("expected lines pushed to a stopped queue to be returned")
+	}
+}
+
+func TestQueueBatch(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		outcomes []error
+		reports  int
+		err      error
+	}{
+		{name: "written", outcomes: []error{nil, nil, nil}, reports: 1},
+		{name: "dropped", outcomes: []error{errDropped, nil, nil}, reports: 1, err: errDropped},
+		{name: "stopped", outcomes: []error{nil, errStopped, errStopped}, reports: 1, err: errStopped},
+		{name: "partly written", outcomes: []error{nil, nil}, reports: 0},
+	}
+
+	for _, test := range tests {
+		reports := 0
+		var reported error
+		batch := &queueBatch{remaining: 3, sent: func(err error) {
+			reports++
+			reported = err
+		}}
+		for _, err := range test.outcomes {
+			batch.report(err)
+		}
+		if reports != test.reports || reported != test.err {
+			t.Errorf("%s: expected %d reports of %v, not %d of %v", test.name, test.reports, test.err, reports, reported)
+		}
+	}
+}
+
+// readPty discards everything written to the device from now on
+//
+func readPty(master *os.File) {
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := master.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// bigLine returns a line too long to fit in the buffer of a pty
+//
+func bigLine() (big []byte) {
+	big = make([]byte, 64*1024)
+	for i := range big {
+		big[i] = 'x'
+	}
+	return big
+}
+
+func TestWriteTimeout(t *testing.T) {
+
+	// Nothing reads from the master end of the pty so writes to the
+	// device block once the pty is full
+	master, name := openPty(t)
+	defer master.Close()
+
+	port, err := serial.OpenPort(&serial.Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	saved := *writeTimeout
+	*writeTimeout = 200 * time.Millisecond
+	defer func() { *writeTimeout = saved }()
+
+	dev := &arduino{port: port, devName: name, outbox: newWriteQueue(2)}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- dev.write(bigLine())
+	}()
+
+	// The write is not abandoned straight away, the timeout is reported
+	// once the write has finished, here once the pty is read again
+	select {
+	case err = <-errC:
+		t.Fatalf("expected the write to wait for the device, not %v", err)
+	case <-time.After(*writeTimeout + 2*flushInterval):
+	}
+	readPty(master)
+
+	select {
+	case err = <-errC:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the write did not finish")
+	}
+	if err == nil {
+		t.Fatal("expected the write to time out")
+	}
+
+	// Closing the device is left to the caller
+	if _, err = port.Write([]byte("x")); err != nil {
+		t.Fatalf("expected the device to remain open, not %v", err)
+	}
+}
+
+func TestWriteAbandoned(t *testing.T) {
+
+	master, name := openPty(t)
+	defer master.Close()
+
+	port, err := serial.OpenPort(&serial.Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := *writeTimeout
+	*writeTimeout = 200 * time.Millisecond
+	defer func() { *writeTimeout = saved }()
+
+	dev := &arduino{port: port, devName: name, portal: "abandoned", key: name, outbox: newWriteQueue(2)}
+	devices.Lock()
+	if devices.devices == nil {
+		devices.devices = map[string]map[string]*arduino{}
+	}
+	devices.devices[dev.portal] = map[string]*arduino{dev.key: dev}
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		delete(devices.devices, dev.portal)
+		devices.Unlock()
+	}()
+
+	sentC := make(chan error, 1)
+	waitingC := make(chan error, 1)
+	dev.outbox.push([]queuedLine{{line: bigLine(), sent: func(err error) { sentC <- err }}})
+	dev.outbox.push([]queuedLine{{line: []byte("waiting"), sent: func(err error) { waitingC <- err }}})
+
+	go dev.writer(dev.outbox)
+
+	// Nothing ever reads the pty, the write is given up on once the output
+	// has been flushed for long enough
+	select {
+	case err = <-sentC:
+	case <-time.After(*writeTimeout + flushAttempts*flushInterval + 2*time.Second):
+		t.Fatal("the write was not abandoned")
+	}
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	// The device is taken offline and closed, and those waiting to write
+	// are told
+	select {
+	case err = <-waitingC:
+	case <-time.After(time.Second):
+		t.Fatal("the device was not taken offline")
+	}
+	if err != errStopped {
+		t.Fatalf("expected the waiting line to be discarded, not %v", err)
+	}
+	devices.Lock()
+	_, running := devices.devices[dev.portal][dev.key]
+	devices.Unlock()
+	if running {
+		t.Fatal("expected the device to be taken offline")
+	}
+	if _, err = port.Write([]byte("x")); err == nil {
+		t.Fatal("expected the device to be closed")
+	}
+
+	// Let the abandoned write finish
+	readPty(master)
+}